@@ -0,0 +1,84 @@
+package apix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/obase/api"
+	"github.com/obase/log"
+	"math/rand"
+	"time"
+)
+
+/*访问日志条目, 每个请求输出一行json*/
+type AccessEntry struct {
+	Time      string  `json:"time"`
+	Transport string  `json:"transport"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path,omitempty"`
+	Peer      string  `json:"peer,omitempty"`
+	ReqSize   int     `json:"reqSize"`
+	RspSize   int     `json:"rspSize"`
+	Code      int     `json:"code"`
+	Latency   float64 `json:"latency"` // 毫秒
+	UserAgent string  `json:"userAgent,omitempty"`
+	TraceId   string  `json:"traceId,omitempty"`
+	RequestId string  `json:"requestId,omitempty"`
+}
+
+// 访问日志的输出目标, *log.Logger满足该接口
+type accessWriter interface {
+	Info(ctx context.Context, format string, args ...interface{})
+}
+
+var accessLog *accessLogger // 为空表示未启用访问日志
+
+type accessLogger struct {
+	writer accessWriter
+	rate   float64 // 成功请求的采样率
+}
+
+// 访问日志使用独立的日志目标, 避免淹没应用日志
+func setupAccessLog(conf *Config) error {
+	if conf.AccessLog == "" {
+		accessLog = nil
+		return nil
+	}
+	logger := log.GetLog(conf.AccessLog)
+	if logger == nil {
+		return errors.New("access logger not found in logger.exts: " + conf.AccessLog)
+	}
+	accessLog = &accessLogger{
+		writer: logger,
+		rate:   *conf.AccessLogSampleRate,
+	}
+	return nil
+}
+
+func writeAccessLog(r *requestRecord, code int, latency time.Duration) {
+	l := accessLog
+	if l == nil {
+		return
+	}
+	if code == api.SUCCESS && l.rate < 1 && rand.Float64() >= l.rate {
+		return
+	}
+	entry := &AccessEntry{
+		Time:      r.start.Format(time.RFC3339Nano),
+		Transport: r.transport,
+		Method:    r.tag,
+		Path:      r.path,
+		Peer:      r.peer,
+		ReqSize:   r.reqSize,
+		RspSize:   r.rspSize,
+		Code:      code,
+		Latency:   float64(latency) / float64(time.Millisecond),
+		UserAgent: r.agent,
+		RequestId: r.requestId,
+	}
+	if r.span != nil {
+		entry.TraceId = r.span.TraceId
+	}
+	bs, _ := json.Marshal(entry)
+	l.writer.Info(r.context(), "%s", bs)
+}
@@ -0,0 +1,71 @@
+package apix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// 记录访问日志
+type recordWriter struct {
+	lines []string
+	ids   []string // 日志ctx中的请求id
+}
+
+func (w *recordWriter) Info(ctx context.Context, format string, args ...interface{}) {
+	w.lines = append(w.lines, fmt.Sprintf(format, args...))
+	w.ids = append(w.ids, RequestId(ctx))
+}
+
+func TestAccessLog(t *testing.T) {
+	writer := &recordWriter{}
+	accessLog = &accessLogger{writer: writer, rate: 0}
+	defer func() {
+		accessLog = nil
+	}()
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.POST("/test", createHandleFunc(func(ctx context.Context, rdata []byte) (interface{}, error) {
+		if string(rdata) == "fail" {
+			return nil, NewError(1001, "failed")
+		}
+		return "ok", nil
+	}, "Test.Access", func(code int) int { return http.StatusOK }))
+
+	for _, body := range []string{"ok", "fail"} {
+		req := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(body))
+		req.Header.Set("User-Agent", "apix-test")
+		engine.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// 采样率为0时只记录失败请求
+	if len(writer.lines) != 1 {
+		t.Fatalf("unexpected access log: %v", writer.lines)
+	}
+	var entry AccessEntry
+	if err := json.Unmarshal([]byte(writer.lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Transport != TRANSPORT_HTTP || entry.Method != "Test.Access" || entry.Path != "/test" || entry.Code != 1001 ||
+		entry.ReqSize != 4 || entry.RspSize == 0 || entry.UserAgent != "apix-test" || entry.Peer == "" {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+	if entry.RequestId == "" || writer.ids[0] != entry.RequestId {
+		t.Fatalf("log context request id %q, entry %q", writer.ids[0], entry.RequestId)
+	}
+}
+
+func TestAccessLogSampleRateZero(t *testing.T) {
+	if rate := *mergeConfig(&Config{AccessLogSampleRate: SampleRate(0)}).AccessLogSampleRate; rate != 0 {
+		t.Fatalf("explicit 0 rewritten to %v", rate)
+	}
+	if rate := *mergeConfig(&Config{}).AccessLogSampleRate; rate != 1 {
+		t.Fatalf("default rate %v", rate)
+	}
+}
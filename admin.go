@@ -0,0 +1,104 @@
+package apix
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"github.com/obase/httpx/ginx"
+	"github.com/obase/log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ADMIN_LISTEN_RETRIES = 30 // 独立端口监听失败的重试次数, 每秒一次
+
+/*管理接口, 统一挂载在AdminPath之下. 配置AdminPort则使用独立端口, 否则挂载到http服务器*/
+type adminRoute struct {
+	path    string
+	handler http.HandlerFunc
+}
+
+func adminRoutes(conf *Config) []adminRoute {
+	return []adminRoute{
+		{path: "/codes", handler: serveCodes},
+		{path: "/sockets", handler: serveSocketStats},
+		{path: "/metrics", handler: serveMetrics},
+		{path: "/slow", handler: serveSlowRequests},
+	}
+}
+
+// 将管理接口挂载到http服务器. http端口对外暴露, 因此需要校验令牌或回环地址
+func registerAdminHttp(httpServer *ginx.Server, conf *Config) {
+	group := httpServer.Group(conf.AdminPath)
+	for _, route := range adminRoutes(conf) {
+		group.GET(route.path, gin.WrapF(guardAdmin(conf, route.handler)))
+	}
+}
+
+// 校验令牌, 只接受Authorization: Bearer <token>, 避免令牌出现在url及访问日志中. 未配置令牌只允许回环地址
+func guardAdmin(conf *Config, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if conf.AdminToken != "" {
+			token := r.Header.Get("Authorization")
+			if !strings.HasPrefix(token, "Bearer ") || subtle.ConstantTimeCompare([]byte(token[len("Bearer "):]), []byte(conf.AdminToken)) != 1 {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		} else if !isLoopback(r.RemoteAddr) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// 独立端口的管理接口及调试接口, 全部校验令牌或回环地址(慢请求等含有请求数据)
+func adminHandler(conf *Config) http.Handler {
+	mux := http.NewServeMux()
+	routes := adminRoutes(conf)
+	if conf.AdminDebug {
+		routes = append(routes, debugRoutes(conf)...)
+	}
+	for _, route := range routes {
+		mux.HandleFunc(conf.AdminPath+route.path, guardAdmin(conf, route.handler))
+	}
+	return mux
+}
+
+// 在独立端口提供管理接口. 重启时旧进程可能尚未释放端口, 因此重试监听, 仍然失败则与grpc/http服务一样退出进程
+func serveAdmin(conf *Config) *http.Server {
+	server := &http.Server{
+		Addr:    net.JoinHostPort(conf.AdminHost, strconv.Itoa(conf.AdminPort)),
+		Handler: adminHandler(conf),
+	}
+	go func() {
+		for retry := 0; ; retry++ {
+			err := server.ListenAndServe()
+			if err == http.ErrServerClosed {
+				return
+			}
+			if retry >= ADMIN_LISTEN_RETRIES {
+				log.Error(nil, "admin server serve error after %v retries: %v", retry, err)
+				log.Flush()
+				os.Exit(1)
+			}
+			if retry == 0 {
+				log.Warn(nil, "admin server listen error, retrying: %v", err)
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+	return server
+}
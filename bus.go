@@ -0,0 +1,234 @@
+package apix
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/obase/log"
+	"github.com/obase/redis"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+跨实例消息总线, 用于在多个apix实例之间扇出推送与广播:
+1. Push/Broadcast先投递本实例的会话, 再发布到总线
+2. 各实例订阅总线, 投递其他实例发布的消息, 忽略自身发布的消息
+*/
+type Bus interface {
+	Publish(msg *BusMessage) error
+	Subscribe(handler func(msg *BusMessage)) error // 非阻塞, 注册处理函数
+	Close()
+}
+
+const (
+	BUS_NONE   = "none"
+	BUS_MEMORY = "memory"
+	BUS_REDIS  = "redis"
+
+	BUS_KIND_PUSH      = "push"
+	BUS_KIND_BROADCAST = "broadcast"
+)
+
+/*总线消息, Frame为已编码的websocket消息*/
+type BusMessage struct {
+	Origin string          `json:"origin"` // 发布实例id
+	Kind   string          `json:"kind"`   // push或broadcast
+	Target string          `json:"target"` // push为会话id或userKey, broadcast为主题
+	Frame  json.RawMessage `json:"frame"`
+}
+
+var (
+	bus      Bus          // 为空表示单实例
+	instance = newBusId() // 本实例id
+)
+
+func newBusId() string {
+	bs := make([]byte, 8)
+	rand.Read(bs)
+	return hex.EncodeToString(bs)
+}
+
+// 根据配置创建总线
+func createBus(conf *Config) (Bus, error) {
+	switch strings.ToLower(conf.WbskBus) {
+	case "", BUS_NONE:
+		return nil, nil
+	case BUS_MEMORY:
+		return NewMemoryBus(), nil
+	case BUS_REDIS:
+		if conf.HttpCache == nil {
+			return nil, errors.New("redis bus requires httpCache redis settings")
+		}
+		return NewRedisBus(&conf.HttpCache.Config, conf.WbskBusChannel)
+	}
+	return nil, errors.New("unknown bus type: " + conf.WbskBus)
+}
+
+// 安装总线并投递其他实例发布的消息
+func setupBus(b Bus) error {
+	bus = b
+	if b == nil {
+		return nil
+	}
+	return b.Subscribe(func(msg *BusMessage) {
+		if msg.Origin == instance {
+			return
+		}
+		switch msg.Kind {
+		case BUS_KIND_PUSH:
+			for _, s := range sessions.lookup(msg.Target) {
+				s.offer(websocket.TextMessage, msg.Frame)
+			}
+		case BUS_KIND_BROADCAST:
+			broadcastFrame(msg.Target, msg.Frame)
+		}
+	})
+}
+
+// 发布到总线, 单实例直接忽略
+func publishBus(kind string, target string, frame []byte) error {
+	if bus == nil {
+		return nil
+	}
+	return bus.Publish(&BusMessage{
+		Origin: instance,
+		Kind:   kind,
+		Target: target,
+		Frame:  frame,
+	})
+}
+
+/*进程内总线, 用于测试或单进程多实例*/
+type memoryBus struct {
+	sync.RWMutex
+	handlers []func(msg *BusMessage)
+}
+
+func NewMemoryBus() Bus {
+	return &memoryBus{}
+}
+
+func (b *memoryBus) Publish(msg *BusMessage) error {
+	b.RLock()
+	defer b.RUnlock()
+	for _, h := range b.handlers {
+		h(msg)
+	}
+	return nil
+}
+
+func (b *memoryBus) Subscribe(handler func(msg *BusMessage)) error {
+	b.Lock()
+	b.handlers = append(b.handlers, handler)
+	b.Unlock()
+	return nil
+}
+
+func (b *memoryBus) Close() {
+	b.Lock()
+	b.handlers = nil
+	b.Unlock()
+}
+
+/*基于redis pub/sub的总线, 复用httpCache的redis连接配置. 订阅使用独立的连接池, Close时由订阅协程关闭以结束阻塞的订阅*/
+type redisBus struct {
+	redis.Redis
+	sub     redis.Redis // 订阅专用, 与httpCache共享的连接池分开
+	channel string
+	closed  chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+}
+
+const (
+	REDIS_BUS_SUFFIX        = ".bus"          // 订阅连接池的key后缀
+	REDIS_BUS_CLOSE_TIMEOUT = 3 * time.Second // Close等待订阅协程退出的时间
+)
+
+func NewRedisBus(config *redis.Config, channel string) (Bus, error) {
+	redis.Setup(config) // 如果与httpCache重复则会报duplicate错误,忽略即可!
+	rdb := redis.Get(config.Key)
+	if rdb == nil {
+		return nil, errors.New("redis setup failed: " + config.Key)
+	}
+	subConf := *config
+	subConf.Key, subConf.Default, subConf.InitConns = config.Key+REDIS_BUS_SUFFIX, false, 0
+	if err := redis.Setup(&subConf); err != nil {
+		return nil, err
+	}
+	return &redisBus{
+		Redis:   rdb,
+		sub:     redis.Get(subConf.Key),
+		channel: channel,
+		closed:  make(chan struct{}),
+	}, nil
+}
+
+func (b *redisBus) Publish(msg *BusMessage) error {
+	bs, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return b.Redis.Pub(b.channel, bs)
+}
+
+func (b *redisBus) Subscribe(handler func(msg *BusMessage)) error {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer b.sub.Close()
+		for {
+			err := b.sub.Sub(b.channel, func(data []byte) {
+				select {
+				case <-b.closed:
+					// 连接池不支持并发关闭, 在订阅协程内关闭连接使Sub返回
+					b.sub.Close()
+					return
+				default:
+				}
+				var msg BusMessage
+				if err := json.Unmarshal(data, &msg); err != nil {
+					log.Error(nil, "redis bus unmarshal error: %v", err)
+					return
+				}
+				handler(&msg)
+			}, nil)
+			select {
+			case <-b.closed:
+				return
+			default:
+			}
+			// 断线重连
+			log.Error(nil, "redis bus subscribe error: %v", err)
+			select {
+			case <-b.closed:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+	return nil
+}
+
+// 发布一条空消息唤醒阻塞的订阅协程, 由其关闭订阅连接, 最多等待REDIS_BUS_CLOSE_TIMEOUT. 发布所用的共享连接池不关闭.
+// 订阅连接池仍登记在redis中(redis未提供注销接口), 同一进程内不能以相同key重建总线
+func (b *redisBus) Close() {
+	b.once.Do(func() {
+		close(b.closed)
+		b.Publish(&BusMessage{Origin: instance})
+	})
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(REDIS_BUS_CLOSE_TIMEOUT):
+		log.Error(nil, "redis bus close: subscription still running after %v", REDIS_BUS_CLOSE_TIMEOUT)
+	}
+}
@@ -0,0 +1,155 @@
+package apix
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/obase/redis"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 本地redis替身, 仅支持PING/PUBLISH/SUBSCRIBE
+type fakeRedis struct {
+	net.Listener
+	sync.Mutex
+	subs map[string][]net.Conn
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRedis{Listener: ln, subs: make(map[string][]net.Conn)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+	return fr
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		switch args[0] {
+		case "PING":
+			fmt.Fprint(conn, "+PONG\r\n")
+		case "SUBSCRIBE":
+			fr.Lock()
+			fr.subs[args[1]] = append(fr.subs[args[1]], conn)
+			fr.Unlock()
+			fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+		case "PUBLISH":
+			fr.Lock()
+			subs := fr.subs[args[1]]
+			for _, sc := range subs {
+				fmt.Fprintf(sc, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(args[1]), args[1], len(args[2]), args[2])
+			}
+			fr.Unlock()
+			fmt.Fprintf(conn, ":%d\r\n", len(subs))
+		default:
+			fmt.Fprint(conn, "-ERR unsupported\r\n")
+		}
+	}
+}
+
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	var n int
+	if _, err := fmt.Fscanf(rd, "*%d\r\n", &n); err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		var size int
+		if _, err := fmt.Fscanf(rd, "$%d\r\n", &size); err != nil {
+			return nil, err
+		}
+		bs := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, bs); err != nil {
+			return nil, err
+		}
+		args[i] = string(bs[:size])
+	}
+	return args, nil
+}
+
+func TestRedisBus(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.Close()
+
+	b, err := NewRedisBus(&redis.Config{Key: "apix-bus-test-" + fr.Addr().String(), Address: []string{fr.Addr().String()}}, "apix.bus.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	received := make(chan *BusMessage, 1)
+	b.Subscribe(func(msg *BusMessage) {
+		received <- msg
+	})
+	time.Sleep(100 * time.Millisecond) // 等待订阅完成
+
+	if err = b.Publish(&BusMessage{Origin: "other", Kind: BUS_KIND_BROADCAST, Target: "guild-1", Frame: []byte(`{"code":0}`)}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		if msg.Target != "guild-1" || string(msg.Frame) != `{"code":0}` {
+			t.Fatalf("unexpected message: %v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for bus message")
+	}
+}
+
+func TestRedisBusClose(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.Close()
+
+	b, err := NewRedisBus(&redis.Config{Key: "apix-bus-close-" + fr.Addr().String(), Address: []string{fr.Addr().String()}}, "apix.bus.close")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Subscribe(func(msg *BusMessage) {})
+	time.Sleep(100 * time.Millisecond) // 等待订阅完成
+
+	done := make(chan struct{})
+	go func() {
+		b.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("close did not end the subscription")
+	}
+}
+
+func TestMemoryBusSkipsOrigin(t *testing.T) {
+	b := NewMemoryBus()
+	count := 0
+	b.Subscribe(func(msg *BusMessage) {
+		if msg.Origin != instance {
+			count++
+		}
+	})
+	b.Publish(&BusMessage{Origin: instance, Kind: BUS_KIND_PUSH, Target: strconv.Itoa(1)})
+	b.Publish(&BusMessage{Origin: "other", Kind: BUS_KIND_PUSH, Target: strconv.Itoa(2)})
+	if count != 1 {
+		t.Fatalf("expect 1 foreign message, got %v", count)
+	}
+}
@@ -0,0 +1,302 @@
+package apix
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/obase/log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+请求与响应捕获, 用于排查客户端报告的问题:
+ 1. 只捕获captureMethods中的方法("*"表示全部), 按captureSampleRate采样, 或由请求携带值为captureToken的X-Apix-Capture头触发
+    (grpc为x-apix-capture元数据, websocket为升级请求头). 未配置captureToken则不接受触发头
+ 2. 每个请求以一行json写入capturePath, 超过captureRotateBytes后轮转, 保留captureRotateFiles个历史文件(0不保留).
+    写入在独立goroutine中进行, 队列已满时丢弃
+ 3. captureRedact中的json路径在写入前替换为"***", 如"password", "user.token", "items.*.secret"
+*/
+const (
+	CAPTURE_HEADER     = "X-Apix-Capture"
+	CAPTURE_METADATA   = "x-apix-capture" // grpc元数据的key
+	CAPTURE_REDACTED   = "***"
+	CAPTURE_QUEUE_SIZE = 1024 // 待写入的捕获记录数
+)
+
+/*捕获记录*/
+type CaptureEntry struct {
+	Time      string      `json:"time"`
+	Transport string      `json:"transport"`
+	Method    string      `json:"method"`
+	Code      int         `json:"code"`
+	RequestId string      `json:"requestId,omitempty"`
+	TraceId   string      `json:"traceId,omitempty"`
+	Request   interface{} `json:"request,omitempty"`
+	Response  interface{} `json:"response,omitempty"`
+}
+
+var capturer *payloadCapturer // 为空表示未启用捕获
+
+type payloadCapturer struct {
+	dropped  int64 // 队列已满丢弃的记录数, 首字段保证atomic操作在32位平台对齐
+	all      bool
+	methods  map[string]bool
+	rate     float64
+	token    string // 触发头的值, 为空不接受触发头
+	redactor payloadRedactor
+	writer   *rotateWriter
+	mu       sync.RWMutex // 保护queue的关闭
+	closed   bool
+	queue    chan []byte
+	done     chan struct{}
+}
+
+func setupCapture(conf *Config) {
+	if capturer != nil {
+		capturer.close()
+		capturer = nil
+	}
+	if len(conf.CaptureMethods) == 0 {
+		return
+	}
+	c := &payloadCapturer{
+		methods:  make(map[string]bool),
+		rate:     conf.CaptureSampleRate,
+		token:    conf.CaptureToken,
+		redactor: newPayloadRedactor(conf.CaptureRedact),
+		writer:   newRotateWriter(conf.CapturePath, conf.CaptureRotateBytes, *conf.CaptureRotateFiles),
+		queue:    make(chan []byte, CAPTURE_QUEUE_SIZE),
+		done:     make(chan struct{}),
+	}
+	for _, m := range conf.CaptureMethods {
+		if m == "*" {
+			c.all = true
+		}
+		c.methods[m] = true
+	}
+	go c.writeLoop()
+	capturer = c
+}
+
+// 是否捕获该请求, trigger为请求携带的触发头, 须与captureToken一致
+func (c *payloadCapturer) want(transport string, tag string, trigger string) bool {
+	if !c.all && !c.methods[tag] && !(transport == TRANSPORT_GRPC && c.methods[grpcMethodTag(tag)]) {
+		return false
+	}
+	if c.token != "" && subtle.ConstantTimeCompare([]byte(trigger), []byte(c.token)) == 1 {
+		return true
+	}
+	return c.rate > 0 && rand.Float64() < c.rate
+}
+
+// 写入捕获文件, 队列关闭后关闭文件
+func (c *payloadCapturer) writeLoop() {
+	defer close(c.done)
+	defer c.writer.Close()
+	for data := range c.queue {
+		c.writer.Write(data)
+		if n := atomic.SwapInt64(&c.dropped, 0); n > 0 {
+			log.Warn(nil, "capture queue full, dropped %v entries", n)
+		}
+	}
+}
+
+// 放入写入队列, 不阻塞请求
+func (c *payloadCapturer) enqueue(data []byte) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.queue <- data:
+	default:
+		atomic.AddInt64(&c.dropped, 1)
+	}
+}
+
+// 关闭队列并等待已入队的记录写完
+func (c *payloadCapturer) close() {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	c.mu.Unlock()
+	<-c.done
+}
+
+func writeCapture(r *requestRecord, code int) {
+	c := capturer
+	if c == nil || !c.want(r.transport, r.tag, r.capture) {
+		return
+	}
+	entry := &CaptureEntry{
+		Time:      r.start.Format(time.RFC3339Nano),
+		Transport: r.transport,
+		Method:    r.tag,
+		Code:      code,
+		RequestId: r.requestId,
+		Request:   c.redactor.redact(r.payload, nil),
+	}
+	if r.transport == TRANSPORT_GRPC {
+		entry.Response = c.redactor.redact(r.response, nil)
+	} else {
+		entry.Response = c.redactor.redact(r.response, []string{"data"}) // http与websocket的响应为信封, 脱敏路径相对于data
+	}
+	if r.span != nil {
+		entry.TraceId = r.span.TraceId
+	}
+	bs, err := json.Marshal(entry)
+	if err != nil {
+		log.Error(nil, "%s capture error: %v", r.tag, err)
+		return
+	}
+	c.enqueue(append(bs, '\n'))
+}
+
+// 脱敏规则, 每项为按"."拆分的json路径. 捕获与慢请求记录共用captureRedact
+type payloadRedactor [][]string
+
+func newPayloadRedactor(paths []string) payloadRedactor {
+	var ret payloadRedactor
+	for _, p := range paths {
+		ret = append(ret, strings.Split(strings.TrimPrefix(p, "$."), "."))
+	}
+	return ret
+}
+
+// 解析为json后按prefix之下的路径脱敏, 非json数据原样保存为字符串
+func (rd payloadRedactor) redact(payload interface{}, prefix []string) interface{} {
+	var bs []byte
+	switch v := payload.(type) {
+	case nil:
+		return nil
+	case []byte:
+		bs = v
+	default:
+		var err error
+		if bs, err = json.Marshal(v); err != nil {
+			return nil
+		}
+	}
+	if len(bs) == 0 {
+		return nil
+	}
+	var value interface{}
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return string(bs)
+	}
+	for _, path := range rd {
+		value = redactPath(value, append(prefix[:len(prefix):len(prefix)], path...))
+	}
+	return value
+}
+
+// 按路径替换值, "*"匹配任意key或数组元素
+func redactPath(value interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return CAPTURE_REDACTED
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if path[0] == "*" || path[0] == k {
+				v[k] = redactPath(e, path[1:])
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				v[i] = redactPath(e, path[1:])
+			}
+		}
+	}
+	return value
+}
+
+/*按大小轮转的文件, 历史文件为<path>.1 ~ <path>.<files>, 数字越大越旧. files为0则轮转时直接删除*/
+type rotateWriter struct {
+	sync.Mutex
+	path  string
+	bytes int64
+	files int
+	file  *os.File
+	size  int64
+}
+
+func newRotateWriter(path string, bytes int64, files int) *rotateWriter {
+	return &rotateWriter{
+		path:  path,
+		bytes: bytes,
+		files: files,
+	}
+}
+
+func (w *rotateWriter) Write(data []byte) {
+	w.Lock()
+	defer w.Unlock()
+	if w.file != nil && w.bytes > 0 && w.size+int64(len(data)) > w.bytes {
+		w.rotate()
+	}
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			log.Error(nil, "capture file %v error: %v", w.path, err)
+			return
+		}
+	}
+	n, err := w.file.Write(data)
+	w.size += int64(n)
+	if err != nil {
+		log.Error(nil, "capture file %v error: %v", w.path, err)
+	}
+}
+
+func (w *rotateWriter) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file, w.size = file, info.Size()
+	return nil
+}
+
+func (w *rotateWriter) rotate() {
+	w.file.Close()
+	w.file = nil
+	os.Remove(w.path + "." + strconv.Itoa(w.files))
+	for i := w.files - 1; i >= 1; i-- {
+		os.Rename(w.path+"."+strconv.Itoa(i), w.path+"."+strconv.Itoa(i+1))
+	}
+	if w.files > 0 {
+		os.Rename(w.path, w.path+".1")
+	} else {
+		os.Remove(w.path)
+	}
+}
+
+func (w *rotateWriter) Close() {
+	w.Lock()
+	defer w.Unlock()
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+}
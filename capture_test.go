@@ -0,0 +1,103 @@
+package apix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.log")
+	setupCapture(mergeConfig(&Config{
+		CaptureMethods: []string{"Test.Capture"},
+		CapturePath:    path,
+		CaptureToken:   "secret",
+		CaptureRedact:  []string{"password", "$.user.token", "items.*.secret"},
+	}))
+	defer setupCapture(&Config{})
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.POST("/test", createHandleFunc(func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return map[string]string{"password": "p2"}, nil
+	}, "Test.Capture", func(code int) int { return http.StatusOK }))
+
+	body := `{"password":"p1","user":{"name":"u1","token":"t1"},"items":[{"secret":"s1","id":1}]}`
+	for _, trigger := range []string{"", "1", "secret"} {
+		req := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(body))
+		req.Header.Set(CAPTURE_HEADER, trigger)
+		engine.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	capturer.close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 采样率为0时只捕获携带正确令牌的请求
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	if len(lines) != 1 {
+		t.Fatalf("unexpected capture: %s", data)
+	}
+	for _, secret := range []string{"p1", "p2", "t1", "s1"} {
+		if bytes.Contains(data, []byte(`"`+secret+`"`)) {
+			t.Fatalf("secret %v should be redacted: %s", secret, data)
+		}
+	}
+	var entry struct {
+		Method  string `json:"method"`
+		Request struct {
+			User  map[string]string        `json:"user"`
+			Items []map[string]interface{} `json:"items"`
+		} `json:"request"`
+	}
+	if err := json.Unmarshal(lines[0], &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Method != "Test.Capture" || entry.Request.User["name"] != "u1" || entry.Request.User["token"] != CAPTURE_REDACTED || entry.Request.Items[0]["id"] != 1.0 {
+		t.Fatalf("unexpected entry: %s", lines[0])
+	}
+}
+
+func TestRotateWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rotate.log")
+	w := newRotateWriter(path, 10, 2)
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		w.Write([]byte(line))
+	}
+	w.Close()
+	for suffix, want := range map[string]string{"": "dddddddd\n", ".1": "cccccccc\n", ".2": "bbbbbbbb\n"} {
+		if data, err := ioutil.ReadFile(path + suffix); err != nil || string(data) != want {
+			t.Fatalf("unexpected %v: %q, %v", path+suffix, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("old file should be removed: %v", err)
+	}
+}
+
+func TestRotateWriterNoHistory(t *testing.T) {
+	if files := *mergeConfig(&Config{CaptureRotateFiles: RotateFiles(0)}).CaptureRotateFiles; files != 0 {
+		t.Fatalf("explicit 0 rewritten to %v", files)
+	}
+	path := filepath.Join(t.TempDir(), "rotate.log")
+	w := newRotateWriter(path, 10, 0)
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n"} {
+		w.Write([]byte(line))
+	}
+	w.Close()
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "bbbbbbbb\n" {
+		t.Fatalf("unexpected %v: %q, %v", path, data, err)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Fatalf("no history file should be kept: %v", err)
+	}
+}
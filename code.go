@@ -0,0 +1,111 @@
+package apix
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/obase/api"
+	"google.golang.org/grpc/codes"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*错误代码元数据*/
+type Code struct {
+	Code        int        `json:"code" bson:"code" yaml:"code"`                      // 响应代码
+	Name        string     `json:"name" bson:"name" yaml:"name"`                      // 常量名称, 用于客户端生成常量
+	HttpStatus  int        `json:"httpStatus" bson:"httpStatus" yaml:"httpStatus"`    // 对应http状态码
+	GrpcCode    codes.Code `json:"grpcCode" bson:"grpcCode" yaml:"grpcCode"`          // 对应grpc状态码
+	GrpcName    string     `json:"grpcName" bson:"grpcName" yaml:"grpcName"`          // 对应grpc状态码名称
+	Description string     `json:"description" bson:"description" yaml:"description"` // 描述, Errorf没有format时作为默认消息
+}
+
+/*apix扩展的响应代码*/
+const (
+	METHOD_NOT_FOUND   = 604 // 方法不存在
+	METHOD_NOT_ALLOWED = 605 // 方法被过滤器拒绝
+	PANIC_ERROR        = 606 // 方法执行中发生panic
+)
+
+var (
+	codeMutex sync.RWMutex
+	codeTable = make(map[int]*Code)
+	codeDups  []string // 重复注册记录, 启动时校验
+)
+
+func init() {
+	RegisterCode(api.SUCCESS, "SUCCESS", http.StatusOK, codes.OK, "成功")
+	RegisterCode(api.UNKNOWN, "UNKNOWN", http.StatusInternalServerError, codes.Unknown, "未知错误")
+	RegisterCode(api.READING_REQUEST_ERROR, "READING_REQUEST_ERROR", http.StatusBadRequest, codes.InvalidArgument, "读取request失败")
+	RegisterCode(api.PARSING_REQUEST_ERROR, "PARSING_REQUEST_ERROR", http.StatusBadRequest, codes.InvalidArgument, "解析request失败")
+	RegisterCode(api.EXECUTE_SERVICE_ERROR, "EXECUTE_SERVICE_ERROR", http.StatusInternalServerError, codes.Internal, "执行service失败")
+	RegisterCode(METHOD_NOT_FOUND, "METHOD_NOT_FOUND", http.StatusNotFound, codes.Unimplemented, "方法不存在")
+	RegisterCode(METHOD_NOT_ALLOWED, "METHOD_NOT_ALLOWED", http.StatusForbidden, codes.PermissionDenied, "方法被拒绝")
+	RegisterCode(PANIC_ERROR, "PANIC_ERROR", http.StatusInternalServerError, codes.Internal, "服务内部异常")
+}
+
+/*注册错误代码. 重复的code或name不会覆盖已有注册, 并在服务启动时报错*/
+func RegisterCode(code int, name string, httpStatus int, grpcCode codes.Code, description string) {
+	codeMutex.Lock()
+	defer codeMutex.Unlock()
+
+	if prev, ok := codeTable[code]; ok {
+		codeDups = append(codeDups, fmt.Sprintf("code %v registered by both %v and %v", code, prev.Name, name))
+		return
+	}
+	for _, prev := range codeTable {
+		if prev.Name == name {
+			codeDups = append(codeDups, fmt.Sprintf("name %v registered by both code %v and %v", name, prev.Code, code))
+			return
+		}
+	}
+	codeTable[code] = &Code{
+		Code:        code,
+		Name:        name,
+		HttpStatus:  httpStatus,
+		GrpcCode:    grpcCode,
+		GrpcName:    grpcCode.String(),
+		Description: description,
+	}
+}
+
+/*查询错误代码注册信息*/
+func LookupCode(code int) (*Code, bool) {
+	codeMutex.RLock()
+	c, ok := codeTable[code]
+	codeMutex.RUnlock()
+	return c, ok
+}
+
+/*按code排序的全部错误代码*/
+func Codes() []*Code {
+	codeMutex.RLock()
+	ret := make([]*Code, 0, len(codeTable))
+	for _, c := range codeTable {
+		ret = append(ret, c)
+	}
+	codeMutex.RUnlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Code < ret[j].Code
+	})
+	return ret
+}
+
+// 启动时校验重复注册
+func validateCodes() error {
+	codeMutex.RLock()
+	defer codeMutex.RUnlock()
+	if len(codeDups) > 0 {
+		return fmt.Errorf("duplicate error codes: %v", strings.Join(codeDups, "; "))
+	}
+	return nil
+}
+
+// 错误代码目录, 供客户端生成常量
+func serveCodes(w http.ResponseWriter, r *http.Request) {
+	data, _ := json.Marshal(Codes())
+	w.Header()["Content-Type"] = api.JsonContentType
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,78 @@
+package apix
+
+import (
+	"github.com/obase/api"
+	"google.golang.org/grpc/codes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// 隔离全局注册表, 测试结束后恢复
+func withCodeTable(t *testing.T) {
+	codeMutex.Lock()
+	table, dups := codeTable, codeDups
+	codeTable = make(map[int]*Code)
+	for k, v := range table {
+		codeTable[k] = v
+	}
+	codeDups = nil
+	codeMutex.Unlock()
+	t.Cleanup(func() {
+		codeMutex.Lock()
+		codeTable, codeDups = table, dups
+		codeMutex.Unlock()
+	})
+}
+
+func TestRegisterCode(t *testing.T) {
+	withCodeTable(t)
+
+	RegisterCode(1001, "PLAYER_NOT_FOUND", http.StatusNotFound, codes.NotFound, "玩家不存在")
+	c, ok := LookupCode(1001)
+	if !ok || c.Name != "PLAYER_NOT_FOUND" || c.HttpStatus != http.StatusNotFound || c.GrpcName != "NotFound" {
+		t.Fatalf("unexpected code: %+v", c)
+	}
+	if _, ok := LookupCode(1002); ok {
+		t.Fatal("unregistered code should not be found")
+	}
+	list := Codes()
+	for i := 1; i < len(list); i++ {
+		if list[i-1].Code >= list[i].Code {
+			t.Fatalf("codes should be sorted: %v, %v", list[i-1].Code, list[i].Code)
+		}
+	}
+	if err := validateCodes(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重复的code或name不覆盖已有注册, 启动时报错
+	RegisterCode(1001, "PLAYER_BANNED", http.StatusForbidden, codes.PermissionDenied, "玩家被封禁")
+	RegisterCode(1003, "PLAYER_NOT_FOUND", http.StatusNotFound, codes.NotFound, "玩家不存在")
+	if c, _ := LookupCode(1001); c.Name != "PLAYER_NOT_FOUND" {
+		t.Fatalf("duplicate should not override: %+v", c)
+	}
+	if _, ok := LookupCode(1003); ok {
+		t.Fatal("duplicate name should not be registered")
+	}
+	err := validateCodes()
+	if err == nil || !strings.Contains(err.Error(), "PLAYER_BANNED") || !strings.Contains(err.Error(), "code 1001 and 1003") {
+		t.Fatalf("unexpected validate error: %v", err)
+	}
+}
+
+func TestNewErrorDescription(t *testing.T) {
+	withCodeTable(t)
+
+	RegisterCode(1004, "RATE_LIMITED", http.StatusTooManyRequests, codes.ResourceExhausted, "超过100%配额")
+	if e := NewError(1004, ""); e.Msg != "超过100%配额" {
+		t.Fatalf("description should be used verbatim: %q", e.Msg)
+	}
+	// 调用方的format总是格式化, 与原有Errorf一致
+	if e := Errorf(1, "100%% done").(*api.Response); e.Msg != "100% done" {
+		t.Fatalf("format without args should still be formatted: %q", e.Msg)
+	}
+	if e := NewError(1004, "玩家%v超过配额", 7); e.Msg != "玩家7超过配额" {
+		t.Fatalf("unexpected msg: %q", e.Msg)
+	}
+}
@@ -0,0 +1,169 @@
+package apix
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+websocket子协议编解码, 负责线上格式与json之间的转换:
+1. 帧解析, 方法调用及推送广播内部都使用json, 编解码只在读写连接时发生
+2. 未协商子协议的连接使用json
+*/
+type SocketCodec interface {
+	Decode(data []byte) ([]byte, error)                  // 线上格式转换为json
+	Encode(mtype int, jdata []byte) (int, []byte, error) // json转换为线上格式, 返回实际消息类型
+}
+
+const (
+	SUBPROTOCOL_JSON     = "json"
+	SUBPROTOCOL_STRUCTPB = "structpb-json" // json包装为google.protobuf.Value, 不是业务消息的protobuf编码
+)
+
+var errUnsafeInteger = errors.New("integer exceeds 2^53, not representable in google.protobuf.Value")
+
+var (
+	codecMutex sync.RWMutex
+	codecTable = map[string]SocketCodec{
+		SUBPROTOCOL_JSON:     jsonCodec{},
+		SUBPROTOCOL_STRUCTPB: structpbCodec{},
+	}
+)
+
+/*注册子协议编解码, 同名覆盖*/
+func RegisterSocketCodec(subprotocol string, codec SocketCodec) {
+	codecMutex.Lock()
+	codecTable[subprotocol] = codec
+	codecMutex.Unlock()
+}
+
+// 查询子协议对应的编解码, 未协商或未注册则使用json
+func lookupSocketCodec(subprotocol string) SocketCodec {
+	codecMutex.RLock()
+	defer codecMutex.RUnlock()
+	if codec, ok := codecTable[subprotocol]; ok {
+		return codec
+	}
+	return jsonCodec{}
+}
+
+// 启动时校验配置的子协议都已注册
+func validateSocketCodecs(conf *Config, services []*Service) error {
+	codecMutex.RLock()
+	defer codecMutex.RUnlock()
+	check := func(protocols []string) error {
+		for _, p := range protocols {
+			if _, ok := codecTable[p]; !ok {
+				return errors.New("unknown websocket subprotocol: " + p)
+			}
+		}
+		return nil
+	}
+	if err := check(conf.WbskSubprotocols); err != nil {
+		return err
+	}
+	for _, smeta := range services {
+		for _, mmeta := range smeta.methods {
+			if err := check(mmeta.socketProtocols); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*json编解码, 原样传递*/
+type jsonCodec struct{}
+
+func (jsonCodec) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (jsonCodec) Encode(mtype int, jdata []byte) (int, []byte, error) {
+	return mtype, jdata, nil
+}
+
+/*
+json-in-Struct编解码, 线上格式为google.protobuf.Value的二进制编码, 客户端可用任意protobuf库解析而无需业务消息的.proto:
+1. Value的数值为double, 超过2^53的整数(如int64 id)会丢失精度, 编解码时直接拒绝, 此类字段应以字符串传输
+2. 需要业务消息的真正protobuf编码时, 用RegisterSocketCodec注册自定义编解码
+*/
+type structpbCodec struct{}
+
+func (structpbCodec) Decode(data []byte) ([]byte, error) {
+	var value structpb.Value
+	if err := proto.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	if !safeStructValue(&value) {
+		return nil, errUnsafeInteger
+	}
+	return protojson.Marshal(&value)
+}
+
+func (structpbCodec) Encode(mtype int, jdata []byte) (int, []byte, error) {
+	if err := checkSafeIntegers(jdata); err != nil {
+		return mtype, nil, err
+	}
+	var value structpb.Value
+	if err := protojson.Unmarshal(jdata, &value); err != nil {
+		return mtype, nil, err
+	}
+	data, err := proto.Marshal(&value)
+	return websocket.BinaryMessage, data, err
+}
+
+// double可精确表示的最大整数
+const maxSafeInteger = 1 << 53
+
+// 客户端发送的整数值超出范围时, 原始整数已经丢失精度
+func safeStructValue(v *structpb.Value) bool {
+	switch k := v.Kind.(type) {
+	case *structpb.Value_NumberValue:
+		n := k.NumberValue
+		return n != math.Trunc(n) || math.Abs(n) <= maxSafeInteger
+	case *structpb.Value_StructValue:
+		for _, f := range k.StructValue.GetFields() {
+			if !safeStructValue(f) {
+				return false
+			}
+		}
+	case *structpb.Value_ListValue:
+		for _, e := range k.ListValue.GetValues() {
+			if !safeStructValue(e) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 检查json中的整数字面量, 小数与指数形式按double处理
+func checkSafeIntegers(jdata []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(jdata))
+	dec.UseNumber()
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if n, ok := tok.(json.Number); ok && !strings.ContainsAny(string(n), ".eE") {
+			if i, err := strconv.ParseInt(string(n), 10, 64); err != nil || i > maxSafeInteger || i < -maxSafeInteger {
+				return errUnsafeInteger
+			}
+		}
+	}
+}
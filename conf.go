@@ -1,9 +1,12 @@
 package apix
 
 import (
+	"github.com/gorilla/websocket"
 	"github.com/obase/conf"
 	"github.com/obase/httpx/cache"
 	"github.com/obase/httpx/ginx"
+	"google.golang.org/grpc/codes"
+	"net/http"
 	"time"
 )
 
@@ -23,12 +26,79 @@ type Config struct {
 	WbskReadBufferSize  int               `json:"wbskReadBufferSize" bson:"wbskReadBufferSize" yaml:"wbskReadBufferSize"`    // 默认4092
 	WbskWriteBufferSize int               `json:"wbskWriteBufferSize" bson:"wbskWriteBufferSize" yaml:"wbskWriteBufferSize"` // 默认4092
 	WbskNotCheckOrigin  bool              `json:"wbskNotCheckOrigin" bson:"wbskNotCheckOrigin" yaml:"wbskNotCheckOrigin"`    // 默认false
+	WbskConcurrency     int               `json:"wbskConcurrency" bson:"wbskConcurrency" yaml:"wbskConcurrency"`             // 每个连接并发处理消息数,大于0启用并发模式. 默认0串行
+	WbskSendQueueSize   int               `json:"wbskSendQueueSize" bson:"wbskSendQueueSize" yaml:"wbskSendQueueSize"`       // 每个连接的发送队列大小,推送与广播在队列满时丢弃. 默认256
+	WbskTopicOps        []string          `json:"wbskTopicOps" bson:"wbskTopicOps" yaml:"wbskTopicOps"`                      // 允许客户端发送的主题控制操作: join,leave,broadcast. 默认不允许
+	WbskBus             string            `json:"wbskBus" bson:"wbskBus" yaml:"wbskBus"`                                     // 跨实例推送与广播总线: none,memory,redis. redis复用httpCache连接配置. 默认none
+	WbskBusChannel      string            `json:"wbskBusChannel" bson:"wbskBusChannel" yaml:"wbskBusChannel"`                // 总线的redis频道. 默认"apix.bus.<name>"
+	WbskMuxPath         string            `json:"wbskMuxPath" bson:"wbskMuxPath" yaml:"wbskMuxPath"`                         // 多路复用的websocket入口路径,每帧通过method指定方法tag. 默认为空不启用
+	WbskPingInterval    time.Duration     `json:"wbskPingInterval" bson:"wbskPingInterval" yaml:"wbskPingInterval"`          // ping间隔. 默认0不启用
+	WbskPongTimeout     time.Duration     `json:"wbskPongTimeout" bson:"wbskPongTimeout" yaml:"wbskPongTimeout"`             // ping之后等待pong的超时. 默认等于ping间隔
+	WbskWriteTimeout    time.Duration     `json:"wbskWriteTimeout" bson:"wbskWriteTimeout" yaml:"wbskWriteTimeout"`          // 写超时. 默认0不限制
+	WbskMaxMessageSize  int64             `json:"wbskMaxMessageSize" bson:"wbskMaxMessageSize" yaml:"wbskMaxMessageSize"`    // 最大消息字节数,超出以1009关闭. 默认0不限制
+	WbskIdleTimeout     time.Duration     `json:"wbskIdleTimeout" bson:"wbskIdleTimeout" yaml:"wbskIdleTimeout"`             // 未收到任何消息的空闲超时. 默认0不限制
+
+	WbskCompression          bool     `json:"wbskCompression" bson:"wbskCompression" yaml:"wbskCompression"`                            // 启用permessage-deflate压缩. 默认false
+	WbskCompressionLevel     int      `json:"wbskCompressionLevel" bson:"wbskCompressionLevel" yaml:"wbskCompressionLevel"`             // 压缩级别-2~9. 默认1
+	WbskCompressionThreshold int      `json:"wbskCompressionThreshold" bson:"wbskCompressionThreshold" yaml:"wbskCompressionThreshold"` // 小于该字节数的消息不压缩. 默认0全部压缩
+	WbskSubprotocols         []string `json:"wbskSubprotocols" bson:"wbskSubprotocols" yaml:"wbskSubprotocols"`                         // 支持的子协议,按优先顺序: json,structpb-json. 默认不协商,使用json
+	WbskAllowOrigins         []string `json:"wbskAllowOrigins" bson:"wbskAllowOrigins" yaml:"wbskAllowOrigins"`                         // 允许的来源,支持"*.example.com"子域名通配. 默认为空使用同源检查
+
+	WbskShutdownGrace  time.Duration `json:"wbskShutdownGrace" bson:"wbskShutdownGrace" yaml:"wbskShutdownGrace"`    // 关闭时停止读取, 等待正在执行的消息及OnClose钩子完成的宽限期. 默认5s
+	WbskShutdownCode   int           `json:"wbskShutdownCode" bson:"wbskShutdownCode" yaml:"wbskShutdownCode"`       // 关闭时发送的关闭码. 默认1001(going away)
+	WbskShutdownReason string        `json:"wbskShutdownReason" bson:"wbskShutdownReason" yaml:"wbskShutdownReason"` // 关闭帧原因,可携带重连提示,不超过123字节. 默认"server shutdown"
+
+	WbskResumeWindow time.Duration `json:"wbskResumeWindow" bson:"wbskResumeWindow" yaml:"wbskResumeWindow"` // 断开后会话保留时长,期间可重连恢复并补发消息. 默认0不启用
+	WbskResumeBuffer int           `json:"wbskResumeBuffer" bson:"wbskResumeBuffer" yaml:"wbskResumeBuffer"` // 每个会话缓存的推送与广播消息数. 默认128
+
+	WbskMaxConnections        int      `json:"wbskMaxConnections" bson:"wbskMaxConnections" yaml:"wbskMaxConnections"`                      // 最大websocket连接数,超出以1013关闭. 默认0不限制
+	WbskMaxConnectionsPerIP   int      `json:"wbskMaxConnectionsPerIP" bson:"wbskMaxConnectionsPerIP" yaml:"wbskMaxConnectionsPerIP"`       // 单IP最大连接数,按对端地址计数,超出以1008关闭. 默认0不限制
+	WbskTrustedProxies        []string `json:"wbskTrustedProxies" bson:"wbskTrustedProxies" yaml:"wbskTrustedProxies"`                      // 可信代理的IP或CIDR,对端为可信代理时从X-Forwarded-For右侧取第一个非可信地址. 默认为空不信任X-Forwarded-For
+	WbskMaxConnectionsPerUser int      `json:"wbskMaxConnectionsPerUser" bson:"wbskMaxConnectionsPerUser" yaml:"wbskMaxConnectionsPerUser"` // 单用户最大连接数,按socketFilter设置或Bind绑定的userKey计数,超出以1008关闭. 默认0不限制
+	WbskMessageRate           float64  `json:"wbskMessageRate" bson:"wbskMessageRate" yaml:"wbskMessageRate"`                               // 每个连接每秒消息数(令牌桶),超出以1008关闭. 默认0不限制
+	WbskMessageBurst          int      `json:"wbskMessageBurst" bson:"wbskMessageBurst" yaml:"wbskMessageBurst"`                            // 令牌桶容量. 默认等于每秒消息数
+
+	HttpStatusCompatible bool        `json:"httpStatusCompatible" bson:"httpStatusCompatible" yaml:"httpStatusCompatible"` // 兼容旧逻辑,总是返回200. 默认false
+	HttpStatusMapping    map[int]int `json:"httpStatusMapping" bson:"httpStatusMapping" yaml:"httpStatusMapping"`          // 响应代码与http状态码映射,覆盖默认映射
+	HttpStatusDefault    int         `json:"httpStatusDefault" bson:"httpStatusDefault" yaml:"httpStatusDefault"`          // 未映射错误代码的http状态码,默认500
+
+	AdminPath   string `json:"adminPath" bson:"adminPath" yaml:"adminPath"`       // 管理接口路径前缀,如"/admin". 默认为空不启用
+	AdminHost   string `json:"adminHost" bson:"adminHost" yaml:"adminHost"`       // 管理接口独立端口的主机
+	AdminPort   int    `json:"adminPort" bson:"adminPort" yaml:"adminPort"`       // 管理接口独立端口,配置后管理接口不再挂载到http服务器. 默认0
+	AdminDebug  bool   `json:"adminDebug" bson:"adminDebug" yaml:"adminDebug"`    // 在管理接口独立端口提供pprof,goroutine及运行时统计. 默认false
+	AdminToken  string `json:"adminToken" bson:"adminToken" yaml:"adminToken"`    // 管理接口令牌,管理接口及调试接口校验. 为空只允许回环地址访问
+	MetricsPath string `json:"metricsPath" bson:"metricsPath" yaml:"metricsPath"` // http服务器上的Prometheus指标路径,如"/metrics". 默认为空不启用
+	I18nPath    string `json:"i18nPath" bson:"i18nPath" yaml:"i18nPath"`          // 本地化消息模板目录,相对conf.yml所在目录. 默认为空不启用
+	I18nDefault string `json:"i18nDefault" bson:"i18nDefault" yaml:"i18nDefault"` // 默认语言,协商失败时使用
 
 	GrpcHost          string        `json:"grpcHost" bson:"grpcHost" yaml:"grpcHost"`                // 默认本机扫描到的第一个私用IP
 	GrpcPort          int           `json:"grpcPort" bson:"grpcPort" yaml:"grpcPort"`                // 若为空表示不启用grpc server
 	GrpcKeepAlive     time.Duration `json:"grpcKeepAlive" bson:"grpcKeepAlive" yaml:"grpcKeepAlive"` // 默认不启用
 	GrpcCheckTimeout  string        `json:"grpcCheckTimeout" bson:"grpcCheckTimeout" yaml:"grpcCheckTimeout"`
 	GrpcCheckInterval string        `json:"grpcCheckInterval" bson:"grpcCheckInterval" yaml:"grpcCheckInterval"`
+
+	GrpcStatusMapping map[int]codes.Code `json:"grpcStatusMapping" bson:"grpcStatusMapping" yaml:"grpcStatusMapping"` // 响应代码与grpc状态码映射,覆盖默认映射
+
+	TraceExporter   string   `json:"traceExporter" bson:"traceExporter" yaml:"traceExporter"`       // 追踪导出器: stdout,otlp. 默认为空不启用追踪
+	TraceEndpoint   string   `json:"traceEndpoint" bson:"traceEndpoint" yaml:"traceEndpoint"`       // otlp导出地址(OTLP/HTTP JSON). 默认"http://127.0.0.1:4318/v1/traces"
+	TraceSampleRate *float64 `json:"traceSampleRate" bson:"traceSampleRate" yaml:"traceSampleRate"` // 新trace的采样率0~1,0不采样新trace,上游已采样的trace总是采样. 默认1
+
+	AccessLog           string   `json:"accessLog" bson:"accessLog" yaml:"accessLog"`                               // 访问日志使用的日志名称,对应logger.exts中的配置. 默认为空不启用
+	AccessLogSampleRate *float64 `json:"accessLogSampleRate" bson:"accessLogSampleRate" yaml:"accessLogSampleRate"` // 成功请求的采样率0~1,0只记录失败请求,失败请求总是记录. 默认1
+
+	RequestIdResponse bool `json:"requestIdResponse" bson:"requestIdResponse" yaml:"requestIdResponse"` // 响应中携带requestId,响应头总是回传. 默认false
+
+	SlowThreshold   time.Duration `json:"slowThreshold" bson:"slowThreshold" yaml:"slowThreshold"`       // 慢请求阈值,Method.SlowThreshold优先. 默认0不启用
+	SlowPayloadSize int           `json:"slowPayloadSize" bson:"slowPayloadSize" yaml:"slowPayloadSize"` // 慢请求记录的请求数据截断长度,按captureRedact脱敏,未配置则不记录. 默认1024
+	SlowBufferSize  int           `json:"slowBufferSize" bson:"slowBufferSize" yaml:"slowBufferSize"`    // 保留最近的慢请求数. 默认100
+
+	CaptureMethods     []string `json:"captureMethods" bson:"captureMethods" yaml:"captureMethods"`             // 捕获请求与响应的方法tag,"*"表示全部. 默认为空不启用
+	CaptureSampleRate  float64  `json:"captureSampleRate" bson:"captureSampleRate" yaml:"captureSampleRate"`    // 捕获采样率0~1. 默认0只捕获携带X-Apix-Capture头的请求
+	CaptureToken       string   `json:"captureToken" bson:"captureToken" yaml:"captureToken"`                   // X-Apix-Capture头须携带的令牌. 默认为空不接受触发头
+	CapturePath        string   `json:"capturePath" bson:"capturePath" yaml:"capturePath"`                      // 捕获文件路径. 默认"apix-capture.log"
+	CaptureRotateBytes int64    `json:"captureRotateBytes" bson:"captureRotateBytes" yaml:"captureRotateBytes"` // 捕获文件轮转字节数. 默认100M
+	CaptureRotateFiles *int     `json:"captureRotateFiles" bson:"captureRotateFiles" yaml:"captureRotateFiles"` // 保留的历史文件数,0不保留. 默认5
+	CaptureRedact      []string `json:"captureRedact" bson:"captureRedact" yaml:"captureRedact"`                // 脱敏的json路径,如"password","user.token","items.*.secret",同时用于慢请求记录
 }
 
 const CKEY = "service"
@@ -41,6 +111,16 @@ func LoadConfig() *Config {
 	return config
 }
 
+/*采样率配置, 用于在代码中设置TraceSampleRate, AccessLogSampleRate. 未设置(nil)使用默认值, 0表示不采样*/
+func SampleRate(rate float64) *float64 {
+	return &rate
+}
+
+/*历史文件数配置, 用于在代码中设置CaptureRotateFiles. 未设置(nil)使用默认值, 0表示不保留历史文件*/
+func RotateFiles(files int) *int {
+	return &files
+}
+
 // 合并默认值
 func mergeConfig(conf *Config) *Config {
 
@@ -55,6 +135,54 @@ func mergeConfig(conf *Config) *Config {
 	if conf.HttpCheckInterval == "" {
 		conf.HttpCheckInterval = "6s"
 	}
+	if conf.WbskSendQueueSize == 0 {
+		conf.WbskSendQueueSize = 256
+	}
+	if conf.WbskShutdownGrace == 0 {
+		conf.WbskShutdownGrace = 5 * time.Second
+	}
+	if conf.WbskShutdownCode == 0 {
+		conf.WbskShutdownCode = websocket.CloseGoingAway
+	}
+	if conf.WbskShutdownReason == "" {
+		conf.WbskShutdownReason = CLOSE_SHUTDOWN
+	}
+	if conf.WbskResumeWindow > 0 && conf.WbskResumeBuffer == 0 {
+		conf.WbskResumeBuffer = 128
+	}
+	if conf.WbskPingInterval > 0 && conf.WbskPongTimeout == 0 {
+		conf.WbskPongTimeout = conf.WbskPingInterval
+	}
+	if conf.WbskBusChannel == "" {
+		conf.WbskBusChannel = "apix.bus." + conf.Name
+	}
+	if conf.HttpStatusDefault == 0 {
+		conf.HttpStatusDefault = http.StatusInternalServerError
+	}
+	if conf.TraceEndpoint == "" {
+		conf.TraceEndpoint = "http://127.0.0.1:4318/v1/traces"
+	}
+	if conf.TraceSampleRate == nil {
+		conf.TraceSampleRate = SampleRate(1)
+	}
+	if conf.AccessLogSampleRate == nil {
+		conf.AccessLogSampleRate = SampleRate(1)
+	}
+	if conf.SlowPayloadSize == 0 {
+		conf.SlowPayloadSize = 1024
+	}
+	if conf.SlowBufferSize == 0 {
+		conf.SlowBufferSize = 100
+	}
+	if conf.CapturePath == "" {
+		conf.CapturePath = "apix-capture.log"
+	}
+	if conf.CaptureRotateBytes == 0 {
+		conf.CaptureRotateBytes = 100 * 1024 * 1024
+	}
+	if conf.CaptureRotateFiles == nil {
+		conf.CaptureRotateFiles = RotateFiles(5)
+	}
 	if conf.GrpcCheckTimeout == "" {
 		conf.GrpcCheckTimeout = "5s"
 	}
@@ -0,0 +1,140 @@
+package apix
+
+import (
+	"encoding/json"
+	"github.com/obase/api"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+调试接口, 只挂载在管理接口的独立端口(adminPort), 配置adminDebug后启用:
+ 1. <adminPath>/debug/pprof/: net/http/pprof的Index, Cmdline, Profile, Symbol, Trace, 挂载在管理接口的独立mux上, 兼容go tool pprof
+ 2. <adminPath>/debug/goroutines: 全部goroutine的堆栈
+ 3. <adminPath>/debug/runtime: GC/内存统计及apix计数(连接数, 各方法执行中的请求数, 监听信息)
+
+配置adminToken则要求Authorization: Bearer <token>, 否则只允许本机回环地址访问
+*/
+const DEBUG_PPROF_PATH = "/debug/pprof/"
+
+var startTime = time.Now()
+
+/*运行时统计*/
+type RuntimeStats struct {
+	Version    string           `json:"version"`
+	Uptime     float64          `json:"uptime"` // 秒
+	Goroutines int              `json:"goroutines"`
+	MaxProcs   int              `json:"maxProcs"`
+	Memory     MemoryStats      `json:"memory"`
+	Sockets    SocketStats      `json:"sockets"`
+	Inflight   map[string]int64 `json:"inflight"` // 按transport/方法tag统计执行中的请求
+	Listeners  []Listener       `json:"listeners"`
+}
+
+type MemoryStats struct {
+	Alloc        uint64  `json:"alloc"`
+	TotalAlloc   uint64  `json:"totalAlloc"`
+	Sys          uint64  `json:"sys"`
+	HeapAlloc    uint64  `json:"heapAlloc"`
+	HeapInuse    uint64  `json:"heapInuse"`
+	HeapObjects  uint64  `json:"heapObjects"`
+	StackInuse   uint64  `json:"stackInuse"`
+	NumGC        uint32  `json:"numGC"`
+	LastGC       string  `json:"lastGC,omitempty"`
+	PauseTotalNs uint64  `json:"pauseTotalNs"`
+	GCCPUPercent float64 `json:"gcCPUPercent"`
+}
+
+type Listener struct {
+	Name string `json:"name"` // http, grpc, admin
+	Addr string `json:"addr"`
+}
+
+// 执行中的请求, 按transport/方法tag计数
+var inflightMethods = struct {
+	sync.Mutex
+	counts map[string]int64
+}{counts: make(map[string]int64)}
+
+func addInflightMethod(transport string, tag string, delta int64) {
+	key := transport + "/" + tag
+	inflightMethods.Lock()
+	if inflightMethods.counts[key] += delta; inflightMethods.counts[key] <= 0 {
+		delete(inflightMethods.counts, key)
+	}
+	inflightMethods.Unlock()
+}
+
+/*当前运行时统计*/
+func GetRuntimeStats(conf *Config) *RuntimeStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	stats := &RuntimeStats{
+		Version:    runtime.Version(),
+		Uptime:     time.Since(startTime).Seconds(),
+		Goroutines: runtime.NumGoroutine(),
+		MaxProcs:   runtime.GOMAXPROCS(0),
+		Memory: MemoryStats{
+			Alloc:        ms.Alloc,
+			TotalAlloc:   ms.TotalAlloc,
+			Sys:          ms.Sys,
+			HeapAlloc:    ms.HeapAlloc,
+			HeapInuse:    ms.HeapInuse,
+			HeapObjects:  ms.HeapObjects,
+			StackInuse:   ms.StackInuse,
+			NumGC:        ms.NumGC,
+			PauseTotalNs: ms.PauseTotalNs,
+			GCCPUPercent: ms.GCCPUFraction * 100,
+		},
+		Sockets:  GetSocketStats(),
+		Inflight: make(map[string]int64),
+	}
+	if ms.LastGC > 0 {
+		stats.Memory.LastGC = time.Unix(0, int64(ms.LastGC)).Format(time.RFC3339Nano)
+	}
+	inflightMethods.Lock()
+	for k, v := range inflightMethods.counts {
+		stats.Inflight[k] = v
+	}
+	inflightMethods.Unlock()
+	if conf.HttpPort > 0 {
+		stats.Listeners = append(stats.Listeners, Listener{Name: "http", Addr: net.JoinHostPort(conf.HttpHost, strconv.Itoa(conf.HttpPort))})
+	}
+	if conf.GrpcPort > 0 {
+		stats.Listeners = append(stats.Listeners, Listener{Name: "grpc", Addr: net.JoinHostPort(conf.GrpcHost, strconv.Itoa(conf.GrpcPort))})
+	}
+	if conf.AdminPort > 0 {
+		stats.Listeners = append(stats.Listeners, Listener{Name: "admin", Addr: net.JoinHostPort(conf.AdminHost, strconv.Itoa(conf.AdminPort))})
+	}
+	return stats
+}
+
+// 调试接口, 与管理接口一样由serveAdmin校验令牌或回环地址
+func debugRoutes(conf *Config) []adminRoute {
+	return []adminRoute{
+		{path: DEBUG_PPROF_PATH, handler: http.StripPrefix(conf.AdminPath, http.HandlerFunc(pprof.Index)).ServeHTTP}, // Index按/debug/pprof/之后的路径查找profile
+		{path: DEBUG_PPROF_PATH + "cmdline", handler: pprof.Cmdline},
+		{path: DEBUG_PPROF_PATH + "profile", handler: pprof.Profile},
+		{path: DEBUG_PPROF_PATH + "symbol", handler: pprof.Symbol},
+		{path: DEBUG_PPROF_PATH + "trace", handler: pprof.Trace},
+		{path: "/debug/goroutines", handler: serveGoroutines},
+		{path: "/debug/runtime", handler: func(w http.ResponseWriter, r *http.Request) {
+			data, _ := json.Marshal(GetRuntimeStats(conf))
+			w.Header()["Content-Type"] = api.JsonContentType
+			w.WriteHeader(http.StatusOK)
+			w.Write(data)
+		}},
+	}
+}
+
+// 全部goroutine的堆栈
+func serveGoroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(allStacks())
+}
@@ -0,0 +1,65 @@
+package apix
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugRoutes(t *testing.T) {
+	serve := func(conf *Config, path string, remote string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remote
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		adminHandler(conf).ServeHTTP(w, req)
+		return w
+	}
+
+	// 未配置令牌只允许回环地址
+	conf := &Config{AdminPath: "/admin", HttpPort: 8000, AdminDebug: true}
+	for _, path := range []string{"/admin/debug/runtime", "/admin/slow", "/admin/codes"} {
+		if w := serve(conf, path, "10.0.0.1:1234", ""); w.Code != http.StatusForbidden {
+			t.Fatalf("remote access to %v should be forbidden: %v", path, w.Code)
+		}
+	}
+	w := serve(conf, "/admin/debug/runtime", "127.0.0.1:1234", "")
+	var stats RuntimeStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || stats.Goroutines == 0 || len(stats.Listeners) != 1 {
+		t.Fatalf("unexpected runtime stats: %s, %v", w.Body.Bytes(), err)
+	}
+	if w := serve(conf, "/admin/debug/pprof/goroutine?debug=1", "[::1]:1234", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goroutine profile") {
+		t.Fatalf("unexpected pprof response: %v %s", w.Code, w.Body.Bytes())
+	}
+	if w := serve(conf, "/admin/debug/pprof/", "127.0.0.1:1234", ""); !strings.Contains(w.Body.String(), "heap?debug=1") {
+		t.Fatalf("unexpected pprof index: %s", w.Body.Bytes())
+	}
+	if w := serve(conf, "/admin/debug/pprof/profile?seconds=1", "127.0.0.1:1234", ""); w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Fatalf("unexpected cpu profile: %v %v", w.Code, w.Body.Len())
+	}
+	if w := serve(conf, "/admin/debug/pprof/cmdline", "127.0.0.1:1234", ""); w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Fatalf("unexpected cmdline: %v %s", w.Code, w.Body.Bytes())
+	}
+	if w := serve(conf, "/admin/debug/pprof/unknown", "127.0.0.1:1234", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown profile should be not found: %v", w.Code)
+	}
+	if w := serve(conf, "/admin/debug/goroutines", "127.0.0.1:1234", ""); !strings.Contains(w.Body.String(), "TestDebugRoutes") {
+		t.Fatalf("unexpected goroutine dump: %s", w.Body.Bytes())
+	}
+
+	// 配置令牌后校验令牌
+	conf.AdminToken = "secret"
+	if w := serve(conf, "/admin/debug/runtime", "127.0.0.1:1234", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("missing token should be unauthorized: %v", w.Code)
+	}
+	if w := serve(conf, "/admin/debug/runtime", "10.0.0.1:1234", "secret"); w.Code != http.StatusOK {
+		t.Fatalf("valid token should be allowed: %v", w.Code)
+	}
+	if w := serve(conf, "/admin/debug/runtime?token=secret", "127.0.0.1:1234", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("token in query should be rejected: %v", w.Code)
+	}
+}
@@ -0,0 +1,166 @@
+package apix
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/obase/api"
+	"time"
+)
+
+/*
+结构化错误, 兼容api.Response:
+1. 支持Details携带任意类型的详情, 序列化到http/websocket响应及grpc状态详情
+2. 支持Unwrap, errors.Is按Code比较, errors.As可转换为*api.Response
+3. cause仅用于日志输出, 不会返回给客户端
+*/
+type Error struct {
+	Code    int           `json:"code" bson:"code" yaml:"code"`                                        // 响应代码
+	Msg     string        `json:"msg,omitempty" bson:"msg,omitempty" yaml:"msg,omitempty"`             // 响应消息
+	Tag     string        `json:"tag,omitempty" bson:"tag,omitempty" yaml:"tag,omitempty"`             // 响应标签
+	Details []*Detail     `json:"details,omitempty" bson:"details,omitempty" yaml:"details,omitempty"` // 错误详情
+	cause   error         // 底层错误, 仅用于日志
+	args    []interface{} // 消息参数, 用于本地化模板
+}
+
+/*错误详情, Type用于客户端识别Value的结构*/
+type Detail struct {
+	Type  string      `json:"type" bson:"type" yaml:"type"`
+	Value interface{} `json:"value,omitempty" bson:"value,omitempty" yaml:"value,omitempty"`
+}
+
+/*预定义详情类型*/
+const (
+	DETAIL_FIELD_VIOLATION = "fieldViolation" // 字段校验错误
+	DETAIL_RETRY_INFO      = "retryInfo"      // 重试提示
+)
+
+type FieldViolation struct {
+	Field       string `json:"field" bson:"field" yaml:"field"`
+	Description string `json:"description" bson:"description" yaml:"description"`
+}
+
+type RetryInfo struct {
+	RetryDelay int64 `json:"retryDelay" bson:"retryDelay" yaml:"retryDelay"` // 建议重试间隔, 单位毫秒
+}
+
+/*创建结构化错误. format总是按fmt.Sprintf格式化; 若format为空则使用RegisterCode注册的描述, 没有参数时描述原样使用*/
+func NewError(code int, format string, args ...interface{}) *Error {
+	var msg string
+	if format != "" {
+		msg = fmt.Sprintf(format, args...)
+	} else if c, ok := LookupCode(code); ok {
+		if msg = c.Description; len(args) > 0 {
+			msg = fmt.Sprintf(c.Description, args...)
+		}
+	}
+	return &Error{
+		Code: code,
+		Msg:  msg,
+		args: args,
+	}
+}
+
+/*包装底层错误. cause只会输出到日志, 不会返回给客户端*/
+func WrapError(cause error, code int, format string, args ...interface{}) *Error {
+	e := NewError(code, format, args...)
+	e.cause = cause
+	return e
+}
+
+func (e *Error) Error() string {
+	bs, _ := json.Marshal(e)
+	if e.cause != nil {
+		return string(bs) + ": " + e.cause.Error()
+	}
+	return string(bs)
+}
+
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// 按Code比较*Error或*api.Response
+func (e *Error) Is(target error) bool {
+	switch t := target.(type) {
+	case *Error:
+		return t.Code == e.Code
+	case *api.Response:
+		return t.Code == e.Code
+	}
+	return false
+}
+
+// 支持errors.As转换为*api.Response
+func (e *Error) As(target interface{}) bool {
+	if t, ok := target.(**api.Response); ok {
+		*t = e.Response()
+		return true
+	}
+	return false
+}
+
+/*转换为api.Response, 丢弃Details*/
+func (e *Error) Response() *api.Response {
+	return &api.Response{
+		Code: e.Code,
+		Msg:  e.Msg,
+		Tag:  e.Tag,
+	}
+}
+
+func (e *Error) WithTag(tag string) *Error {
+	e.Tag = tag
+	return e
+}
+
+func (e *Error) WithDetail(typ string, value interface{}) *Error {
+	e.Details = append(e.Details, &Detail{
+		Type:  typ,
+		Value: value,
+	})
+	return e
+}
+
+func (e *Error) WithFieldViolation(field string, description string) *Error {
+	return e.WithDetail(DETAIL_FIELD_VIOLATION, &FieldViolation{
+		Field:       field,
+		Description: description,
+	})
+}
+
+func (e *Error) WithRetryDelay(delay time.Duration) *Error {
+	return e.WithDetail(DETAIL_RETRY_INFO, &RetryInfo{
+		RetryDelay: int64(delay / time.Millisecond),
+	})
+}
+
+// 提取错误链中的*Error或*api.Response
+func asError(err error) (*Error, bool) {
+	var xe *Error
+	if errors.As(err, &xe) {
+		return xe, true
+	}
+	var ae *api.Response
+	if errors.As(err, &ae) {
+		return &Error{
+			Code: ae.Code,
+			Msg:  ae.Msg,
+			Tag:  ae.Tag,
+			args: argsOf(ae),
+		}, true
+	}
+	return nil, false
+}
+
+// 将服务返回的错误转换为响应错误. 非apix错误统一为EXECUTE_SERVICE_ERROR
+func toError(err error, tag string) *Error {
+	if e, ok := asError(err); ok {
+		return e
+	}
+	return &Error{
+		Code: api.EXECUTE_SERVICE_ERROR,
+		Msg:  err.Error(),
+		Tag:  tag,
+	}
+}
@@ -0,0 +1,58 @@
+package apix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/obase/api"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorWrap(t *testing.T) {
+	cause := errors.New("db connection refused")
+	err := fmt.Errorf("query player: %w", WrapError(cause, 1001, "player %v not found", 7).WithFieldViolation("id", "not exists"))
+
+	if !errors.Is(err, cause) {
+		t.Fatal("errors.Is should match cause")
+	}
+	if !errors.Is(err, &api.Response{Code: 1001}) {
+		t.Fatal("errors.Is should match api.Response by code")
+	}
+	var rsp *api.Response
+	if !errors.As(err, &rsp) || rsp.Code != 1001 || rsp.Msg != "player 7 not found" {
+		t.Fatalf("errors.As api.Response: %v", rsp)
+	}
+
+	bs, _ := json.Marshal(toError(err, "IPlayer.Get"))
+	if strings.Contains(string(bs), "refused") {
+		t.Fatalf("cause leaked: %s", bs)
+	}
+}
+
+func TestGrpcErrorRoundTrip(t *testing.T) {
+	mapping := createGrpcStatusFunc(mergeConfig(nil))
+	err := NewError(api.PARSING_REQUEST_ERROR, "bad json").WithTag("IPlayer.Add").WithRetryDelay(time.Second)
+
+	back := FromGrpcError(toGrpcError(context.Background(), err, mapping))
+	xe, ok := back.(*Error)
+	if !ok {
+		t.Fatalf("expect *Error, got %T", back)
+	}
+	if xe.Code != api.PARSING_REQUEST_ERROR || xe.Tag != "IPlayer.Add" || len(xe.Details) != 1 || xe.Details[0].Type != DETAIL_RETRY_INFO {
+		t.Fatalf("round trip mismatch: %v", xe)
+	}
+}
+
+func TestErrorfCompatible(t *testing.T) {
+	for _, err := range []error{Errorf(1001, "player %v not found", 7), ParsingRequestError(errors.New("bad json"), "IPlayer.Add")} {
+		if _, ok := err.(*api.Response); !ok {
+			t.Fatalf("expect *api.Response, got %T", err)
+		}
+	}
+	if e := toError(Errorf(1001, "player %v not found", 7), "IPlayer.Get"); e.Code != 1001 || e.Msg != "player 7 not found" {
+		t.Fatalf("unexpected error: %v", e)
+	}
+}
@@ -3,11 +3,17 @@ module github.com/obase/apix
 go 1.12
 
 require (
-	github.com/golang/protobuf v1.3.5
+	github.com/gin-gonic/gin v1.6.2
+	github.com/golang/protobuf v1.5.4
 	github.com/gorilla/websocket v1.4.2
 	github.com/obase/api v1.8.0
 	github.com/obase/center v1.8.0
 	github.com/obase/conf v1.8.0
 	github.com/obase/httpx v1.8.0
 	github.com/obase/log v1.8.0
+	github.com/obase/redis v1.8.0
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260706201446-f0a921348800
+	google.golang.org/grpc v1.84.0
+	google.golang.org/protobuf v1.36.11
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,102 @@
+package apix
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/websocket"
+)
+
+/*websocket生命周期钩子, ctx为方法收到的context, 可用GetSession(ctx)获取会话*/
+type (
+	SocketConnectFunc func(ctx context.Context, s *Session) error                          // 连接建立后执行, 返回错误则拒绝连接
+	SocketMessageFunc func(ctx context.Context, s *Session, rdata []byte) error            // 每条消息执行方法前执行, 返回错误则回复该错误且不执行方法
+	SocketCloseFunc   func(ctx context.Context, s *Session, reason string)                 // 连接关闭后执行, reason为终止原因
+	SocketTopicFunc   func(ctx context.Context, s *Session, op string, topic string) error // 客户端主题操作前执行(在OnMessage之后), 返回错误则回复该错误且不执行操作
+)
+
+/*OnConnect返回该错误可指定关闭码, 其他错误以1008(policy violation)关闭*/
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("close %v: %v", e.Code, e.Reason)
+}
+
+/*拒绝连接并以code关闭*/
+func RejectConnection(code int, reason string) error {
+	return &CloseError{Code: code, Reason: reason}
+}
+
+// 合并后的钩子, Service的钩子先于Method的钩子执行
+type socketHooks struct {
+	onConnect []SocketConnectFunc
+	onMessage []SocketMessageFunc
+	onClose   []SocketCloseFunc
+	onTopic   []SocketTopicFunc
+}
+
+func newSocketHooks(gs *Service, gm *Method) *socketHooks {
+	h := &socketHooks{}
+	h.onConnect = append(append(h.onConnect, gs.onConnect...), gm.onConnect...)
+	h.onMessage = append(append(h.onMessage, gs.onMessage...), gm.onMessage...)
+	h.onClose = append(append(h.onClose, gs.onClose...), gm.onClose...)
+	h.onTopic = append(append(h.onTopic, gs.onTopic...), gm.onTopic...)
+	return h
+}
+
+func (h *socketHooks) connect(ctx context.Context, s *Session) error {
+	for _, f := range h.onConnect {
+		if err := f(ctx, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 在方法前执行OnMessage钩子
+func (h *socketHooks) message(af MethodFunc) MethodFunc {
+	if len(h.onMessage) == 0 {
+		return af
+	}
+	return func(ctx context.Context, rdata []byte) (interface{}, error) {
+		s := GetSession(ctx)
+		for _, f := range h.onMessage {
+			if err := f(ctx, s, rdata); err != nil {
+				return nil, err
+			}
+		}
+		return af(ctx, rdata)
+	}
+}
+
+// 客户端主题操作同样先执行OnMessage钩子(消息数据为帧的data), 再按操作与主题执行OnTopic钩子
+func (h *socketHooks) topic(ctx context.Context, s *Session, frame *socketFrame) error {
+	for _, f := range h.onMessage {
+		if err := f(ctx, s, frame.Data); err != nil {
+			return err
+		}
+	}
+	for _, f := range h.onTopic {
+		if err := f(ctx, s, frame.Op, frame.Topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *socketHooks) close(ctx context.Context, s *Session) {
+	reason := s.Reason()
+	for _, f := range h.onClose {
+		f(ctx, s, reason)
+	}
+}
+
+// OnConnect拒绝连接时的关闭码
+func rejectCloseCode(err error) (int, string) {
+	if ce, ok := err.(*CloseError); ok {
+		return ce.Code, ce.Reason
+	}
+	return websocket.ClosePolicyViolation, err.Error()
+}
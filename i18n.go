@@ -0,0 +1,179 @@
+package apix
+
+import (
+	"fmt"
+	"github.com/obase/api"
+	"github.com/obase/conf"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+/*
+本地化错误消息:
+1. I18nPath目录下每个<locale>.yml文件对应一种语言, 内容为"响应代码: 消息模板", 模板采用fmt格式, 参数与Errorf一致
+2. 按Accept-Language(http/websocket)或accept-language元数据(grpc)协商语言, 找不到则使用I18nDefault
+3. 没有对应模板则保持原消息
+*/
+type i18nCatalog struct {
+	deflang   string                    // 默认语言
+	templates map[string]map[int]string // locale(小写) -> code -> template
+}
+
+var i18n *i18nCatalog // 为空表示未启用
+
+// Errorf与ParsingRequestError返回*api.Response, 无法携带消息参数, 因此按对象地址记录参数供本地化模板使用.
+// 以地址而非指针为key避免记录本身阻止回收, 对象回收时由finalizer删除记录
+var responseArgs sync.Map // uintptr -> []interface{}
+
+// 记录响应的消息参数, 未启用本地化或没有参数时不记录
+func rememberArgs(rsp *api.Response, args []interface{}) *api.Response {
+	if i18n == nil || len(args) == 0 {
+		return rsp
+	}
+	responseArgs.Store(uintptr(unsafe.Pointer(rsp)), args)
+	runtime.SetFinalizer(rsp, func(rsp *api.Response) {
+		responseArgs.Delete(uintptr(unsafe.Pointer(rsp)))
+	})
+	return rsp
+}
+
+func argsOf(rsp *api.Response) []interface{} {
+	if args, ok := responseArgs.Load(uintptr(unsafe.Pointer(rsp))); ok {
+		return args.([]interface{})
+	}
+	return nil
+}
+
+// 加载消息模板, 相对路径以conf.yml所在目录为准
+func loadI18n(config *Config) error {
+	if config.I18nPath == "" {
+		i18n = nil
+		return nil
+	}
+	dir := resolveConfPath(config.I18nPath)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	catalog := &i18nCatalog{
+		deflang:   strings.ToLower(config.I18nDefault),
+		templates: make(map[string]map[int]string),
+	}
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if file.IsDir() || (ext != ".yml" && ext != ".yaml") {
+			continue
+		}
+		bs, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return err
+		}
+		var templates map[int]string
+		if err = yaml.Unmarshal(bs, &templates); err != nil {
+			return err
+		}
+		catalog.templates[strings.ToLower(strings.TrimSuffix(file.Name(), ext))] = templates
+	}
+	i18n = catalog
+	return nil
+}
+
+// 相对路径依次查找: 环境变量CONF_YAML所在目录, 可执行文件目录, 工作目录. 与conf.yml的查找顺序一致
+func resolveConfPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	if cpath := os.Getenv(conf.CONF_YAML_ENV); cpath != "" {
+		return filepath.Join(filepath.Dir(cpath), path)
+	}
+	if loc, err := exec.LookPath(os.Args[0]); err == nil {
+		if ret := filepath.Join(filepath.Dir(loc), path); exists(ret) {
+			return ret
+		}
+	}
+	dir, _ := os.Getwd()
+	return filepath.Join(dir, path)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// 解析Accept-Language, 按q值降序返回小写的语言标签
+func parseAcceptLanguage(accept string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var items []weighted
+	for _, part := range strings.Split(accept, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		q := 1.0
+		if pos := strings.IndexByte(part, ';'); pos >= 0 {
+			if param := strings.TrimSpace(part[pos+1:]); strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+			part = strings.TrimSpace(part[:pos])
+		}
+		if part != "*" && q > 0 {
+			items = append(items, weighted{tag: strings.ToLower(strings.Replace(part, "_", "-", -1)), q: q})
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].q > items[j].q
+	})
+	ret := make([]string, len(items))
+	for i, item := range items {
+		ret[i] = item.tag
+	}
+	return ret
+}
+
+// 查找code对应的模板: 精确匹配 > 主语言匹配 > 默认语言
+func (c *i18nCatalog) lookup(code int, accept string) (string, bool) {
+	for _, tag := range parseAcceptLanguage(accept) {
+		if tpl, ok := c.templates[tag][code]; ok {
+			return tpl, true
+		}
+		if pos := strings.IndexByte(tag, '-'); pos > 0 {
+			if tpl, ok := c.templates[tag[:pos]][code]; ok {
+				return tpl, true
+			}
+		}
+	}
+	tpl, ok := c.templates[c.deflang][code]
+	return tpl, ok
+}
+
+// 按协商语言渲染错误消息, 返回副本避免修改共享的错误对象
+func localizeError(e *Error, accept string) *Error {
+	if i18n == nil {
+		return e
+	}
+	tpl, ok := i18n.lookup(e.Code, accept)
+	if !ok {
+		return e
+	}
+	// 模板需要参数而错误没有参数时保持原消息, 避免渲染为%!v(MISSING)
+	if len(e.args) == 0 && strings.Contains(strings.Replace(tpl, "%%", "", -1), "%") {
+		return e
+	}
+	ret := *e
+	ret.Msg = fmt.Sprintf(tpl, e.args...)
+	return &ret
+}
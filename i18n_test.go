@@ -0,0 +1,58 @@
+package apix
+
+import (
+	"errors"
+	"github.com/obase/api"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	cases := map[string][]string{
+		"":                                 {},
+		"zh-CN":                            {"zh-cn"},
+		"en-US,en;q=0.8,zh_CN;q=0.9":       {"en-us", "zh-cn", "en"},
+		"fr;q=0.5, de ; q=0.7, *;q=0.1":    {"de", "fr"},
+		"ja;q=0,ko":                        {"ko"},
+		"zh-TW;q=0.3,zh-HK;q=0.3,en;q=abc": {"en", "zh-tw", "zh-hk"},
+	}
+	for accept, want := range cases {
+		if got := parseAcceptLanguage(accept); !reflect.DeepEqual(got, want) {
+			t.Errorf("parseAcceptLanguage(%q) = %v, want %v", accept, got, want)
+		}
+	}
+}
+
+func TestLocalizeError(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "zh-CN.yml"), []byte("1001: \"玩家%v不存在\"\n602: \"请求格式错误(%v)\"\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "en.yml"), []byte("1001: \"player %v not found\"\n"), 0644)
+	if err := loadI18n(&Config{I18nPath: dir, I18nDefault: "zh-CN"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		i18n = nil
+	}()
+
+	cases := []struct {
+		err    *Error
+		accept string
+		want   string
+	}{
+		{NewError(1001, "player %v missing", 7), "zh-CN", "玩家7不存在"},
+		{NewError(1001, "player %v missing", 7), "en-GB,zh;q=0.5", "player 7 not found"},        // 主语言匹配
+		{NewError(1001, "player %v missing", 7), "fr", "玩家7不存在"},                                // 默认语言
+		{NewError(1002, "other %v", 7), "en", "other 7"},                                        // 没有模板保持原消息
+		{toError(Errorf(1001, "player %v missing", 7), ""), "zh-CN", "玩家7不存在"},                  // Errorf保留参数
+		{toError(ParsingRequestError(errors.New("bad"), "IPlayer.Add"), ""), "", "请求格式错误(bad)"}, // 参数为错误消息
+		{toError(Errorf(1001, "player missing"), ""), "zh-CN", "player missing"},                // 模板需要参数而没有参数时保持原消息
+		{&Error{Code: api.READING_REQUEST_ERROR, Msg: "eof"}, "zh-CN", "eof"},
+	}
+	for _, c := range cases {
+		if got := localizeError(c.err, c.accept).Msg; got != c.want {
+			t.Errorf("localizeError(%v, %q) = %q, want %q", c.err.Code, c.accept, got, c.want)
+		}
+	}
+}
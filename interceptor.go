@@ -0,0 +1,254 @@
+package apix
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	"github.com/obase/api"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"strconv"
+	"strings"
+)
+
+const (
+	GRPC_ERROR_DOMAIN = "apix" // grpc错误详情的domain
+	GRPC_ERROR_CODE   = "code" // grpc错误详情中响应代码的key
+	GRPC_ERROR_TAG    = "tag"  // grpc错误详情中响应标签的key
+	GRPC_DETAIL_TYPE  = "type" // grpc错误详情中Detail类型的key
+	GRPC_DETAIL_VALUE = "value"
+
+	GRPC_ACCEPT_LANGUAGE = "accept-language" // grpc元数据中的语言协商key
+)
+
+/*将*Error或*api.Response错误转换为grpc状态错误, 原始code/tag放在ErrorInfo详情中, Details转为Struct详情*/
+func toGrpcError(ctx context.Context, err error, mapping func(code int) codes.Code) error {
+	ersp, ok := asError(err)
+	if !ok {
+		return err
+	}
+	ersp = localizeError(ersp, grpcAcceptLanguage(ctx))
+	gcode := mapping(ersp.Code)
+	if gcode == codes.OK {
+		// 错误映射为OK会使st.Err()返回nil, 调用方误认为成功
+		gcode = codes.Unknown
+	}
+	st := status.New(gcode, ersp.Msg)
+	if dst, derr := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: strconv.Itoa(ersp.Code),
+		Domain: GRPC_ERROR_DOMAIN,
+		Metadata: map[string]string{
+			GRPC_ERROR_CODE: strconv.Itoa(ersp.Code),
+			GRPC_ERROR_TAG:  ersp.Tag,
+		},
+	}); derr == nil {
+		st = dst
+	}
+	for _, detail := range ersp.Details {
+		if sd, derr := toStructDetail(detail); derr == nil {
+			if dst, derr := st.WithDetails(sd); derr == nil {
+				st = dst
+			}
+		}
+	}
+	return st.Err()
+}
+
+// grpc元数据中的accept-language
+func grpcAcceptLanguage(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vals := md.Get(GRPC_ACCEPT_LANGUAGE); len(vals) > 0 {
+			return strings.Join(vals, ",")
+		}
+	}
+	return ""
+}
+
+// Detail的Value经json转换为通用结构
+func toStructDetail(detail *Detail) (*structpb.Struct, error) {
+	var value interface{}
+	if detail.Value != nil {
+		bs, err := json.Marshal(detail.Value)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(bs, &value); err != nil {
+			return nil, err
+		}
+	}
+	return structpb.NewStruct(map[string]interface{}{
+		GRPC_DETAIL_TYPE:  detail.Type,
+		GRPC_DETAIL_VALUE: value,
+	})
+}
+
+/*将grpc状态错误还原为*Error(可用errors.As转换为*api.Response), 非apix错误原样返回. 供grpc客户端使用*/
+func FromGrpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	var ret *Error
+	for _, detail := range st.Details() {
+		switch d := detail.(type) {
+		case *errdetails.ErrorInfo:
+			if d.Domain != GRPC_ERROR_DOMAIN {
+				continue
+			}
+			code, cerr := strconv.Atoi(d.Metadata[GRPC_ERROR_CODE])
+			if cerr != nil {
+				return err
+			}
+			ret = &Error{
+				Code: code,
+				Msg:  st.Message(),
+				Tag:  d.Metadata[GRPC_ERROR_TAG],
+			}
+		case *structpb.Struct:
+			if ret == nil {
+				continue
+			}
+			values := d.AsMap()
+			if typ, ok := values[GRPC_DETAIL_TYPE].(string); ok {
+				ret.Details = append(ret.Details, &Detail{
+					Type:  typ,
+					Value: values[GRPC_DETAIL_VALUE],
+				})
+			}
+		}
+	}
+	if ret == nil {
+		return err
+	}
+	return ret
+}
+
+func createUnaryServerInterceptor(mapping func(code int) codes.Code) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		code := api.UNKNOWN
+		span := startSpan(grpcTraceparent(ctx), info.FullMethod, SPAN_KIND_SERVER)
+		record := beginGrpcRequest(ctx, info.FullMethod, span)
+		record.reqSize, record.payload = grpcMessageSize(req), req
+		defer func() {
+			record.finish(code)
+		}()
+		grpc.SetHeader(ctx, metadata.Pairs(REQUEST_ID_METADATA, record.requestId))
+		ctx = context.WithValue(ctx, REQUEST_ID_KEY, record.requestId)
+		if span != nil {
+			ctx = context.WithValue(ctx, TRACE_SPAN_KEY, span)
+		}
+		rsp, err := invokeMethod(ctx, TRANSPORT_GRPC, info.FullMethod, func() (interface{}, error) {
+			return handler(ctx, req)
+		})
+		code = grpcResultCode(err)
+		record.rspSize, record.response = grpcMessageSize(rsp), rsp
+		if err != nil {
+			err = toGrpcError(ctx, err, mapping)
+		}
+		return rsp, err
+	}
+}
+
+func createStreamServerInterceptor(mapping func(code int) codes.Code) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		code := api.UNKNOWN
+		span := startSpan(grpcTraceparent(ss.Context()), info.FullMethod, SPAN_KIND_SERVER)
+		record := beginGrpcRequest(ss.Context(), info.FullMethod, span)
+		defer func() {
+			record.finish(code)
+		}()
+		ss.SetHeader(metadata.Pairs(REQUEST_ID_METADATA, record.requestId))
+		ctx := context.WithValue(ss.Context(), REQUEST_ID_KEY, record.requestId)
+		if span != nil {
+			ctx = context.WithValue(ctx, TRACE_SPAN_KEY, span)
+		}
+		ss = &contextServerStream{ServerStream: ss, ctx: ctx}
+		_, err := invokeMethod(ss.Context(), TRANSPORT_GRPC, info.FullMethod, func() (interface{}, error) {
+			return nil, handler(srv, ss)
+		})
+		code = grpcResultCode(err)
+		if err != nil {
+			err = toGrpcError(ss.Context(), err, mapping)
+		}
+		return err
+	}
+}
+
+// grpc元数据中的traceparent
+func grpcTraceparent(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vals := md.Get(TRACE_HEADER); len(vals) > 0 {
+			return vals[0]
+		}
+	}
+	return ""
+}
+
+// 记录grpc请求开始, 附加请求id, 对端地址与user-agent
+func beginGrpcRequest(ctx context.Context, method string, span *Span) *requestRecord {
+	record := beginRequest(ctx, TRANSPORT_GRPC, method, span)
+	record.requestId = ensureRequestId(grpcRequestId(ctx))
+	record.path = method
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		record.peer = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vals := md.Get("user-agent"); len(vals) > 0 {
+			record.agent = vals[0]
+		}
+		if vals := md.Get(CAPTURE_METADATA); len(vals) > 0 {
+			record.capture = vals[0]
+		}
+	}
+	return record
+}
+
+// protobuf消息的编码大小, 非protobuf消息返回0
+func grpcMessageSize(msg interface{}) int {
+	if m, ok := msg.(proto.Message); ok && m != nil {
+		return proto.Size(m)
+	}
+	return 0
+}
+
+// 携带请求id及span的ServerStream
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (ss *contextServerStream) Context() context.Context {
+	return ss.ctx
+}
+
+// 用于指标的响应代码
+func grpcResultCode(err error) int {
+	if err == nil {
+		return api.SUCCESS
+	}
+	return toError(err, "").Code
+}
+
+/*客户端拦截器, 自动将apix服务端返回的grpc状态错误还原为*Error. 转发ctx中的请求id, ctx携带span时为下游调用创建client span并注入traceparent*/
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if id := RequestId(ctx); id != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, REQUEST_ID_METADATA, id)
+		}
+		span := SpanFromContext(ctx).child(method, SPAN_KIND_CLIENT)
+		if span != nil {
+			ctx = metadata.AppendToOutgoingContext(ctx, TRACE_HEADER, span.Traceparent())
+		}
+		err := FromGrpcError(invoker(ctx, method, req, reply, cc, opts...))
+		span.finish(grpcResultCode(err))
+		return err
+	}
+}
@@ -0,0 +1,54 @@
+package apix
+
+import (
+	"context"
+	"github.com/obase/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"testing"
+)
+
+func TestGrpcStatusFunc(t *testing.T) {
+	if _, ok := LookupCode(40901); !ok {
+		RegisterCode(40901, "TEST_GRPC_CONFLICT", http.StatusConflict, codes.Aborted, "测试")
+	}
+	cases := []struct {
+		name string
+		conf *Config
+		code int
+		want codes.Code
+	}{
+		{"registry", &Config{}, 40901, codes.Aborted},
+		{"builtin", &Config{}, api.PARSING_REQUEST_ERROR, codes.InvalidArgument},
+		{"unregistered", &Config{}, 40902, codes.Unknown},
+		{"mapping over registry", &Config{GrpcStatusMapping: map[int]codes.Code{40901: codes.FailedPrecondition}}, 40901, codes.FailedPrecondition},
+		{"mapping unregistered", &Config{GrpcStatusMapping: map[int]codes.Code{40902: codes.NotFound}}, 40902, codes.NotFound},
+	}
+	for _, c := range cases {
+		if got := createGrpcStatusFunc(mergeConfig(c.conf))(c.code); got != c.want {
+			t.Errorf("%s: status(%v) = %v, want %v", c.name, c.code, got, c.want)
+		}
+	}
+}
+
+func TestGrpcErrorMappedToOK(t *testing.T) {
+	mapping := createGrpcStatusFunc(mergeConfig(&Config{GrpcStatusMapping: map[int]codes.Code{40903: codes.OK}}))
+	err := toGrpcError(context.Background(), NewError(40903, "conflict"), mapping)
+	if err == nil || status.Code(err) != codes.Unknown {
+		t.Fatalf("error mapped to OK should fall back to Unknown: %v", err)
+	}
+	if xe, ok := FromGrpcError(err).(*Error); !ok || xe.Code != 40903 || xe.Msg != "conflict" {
+		t.Fatalf("round trip mismatch: %v", err)
+	}
+}
+
+func TestFromGrpcErrorForeign(t *testing.T) {
+	foreign := status.Error(codes.NotFound, "not apix")
+	if back := FromGrpcError(foreign); back != foreign {
+		t.Fatalf("foreign status should be returned as is: %v", back)
+	}
+	if FromGrpcError(nil) != nil {
+		t.Fatal("nil should stay nil")
+	}
+}
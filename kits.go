@@ -4,10 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/websocket"
 	"github.com/obase/api"
 	"github.com/obase/log"
-	"net/http"
 )
 
 const (
@@ -18,31 +16,28 @@ const (
 	GRACE_ALL  = "3" // grpc是3, http是4
 )
 
-/*封装错误类型*/
+/*封装错误类型. 返回*api.Response以兼容已有的类型断言*/
 func ParsingRequestError(err error, tag string) error {
-	return &api.Response{
+	return rememberArgs(&api.Response{
 		Code: api.PARSING_REQUEST_ERROR,
 		Msg:  err.Error(),
 		Tag:  tag,
-	}
+	}, []interface{}{err.Error()})
 }
 
-/*创建错误对象*/
+/*创建错误对象. 若format为空则使用RegisterCode注册的描述作为消息. 返回*api.Response以兼容已有的类型断言, 需要Details或本地化参数时使用NewError*/
 func Errorf(code int, format string, args ...interface{}) error {
-	return &api.Response{
-		Code: code,
-		Msg:  fmt.Sprintf(format, args...),
-	}
+	return rememberArgs(NewError(code, format, args...).Response(), args)
 }
 
-// TODO: 附加访问时长
+// 兜底恢复方法之外的panic, 方法内的panic由invokeMethod转换为错误响应
 func recoverHandleFunc(c *gin.Context) {
 	if perr := recover(); perr != nil {
 		log.ErrorStack(c, fmt.Errorf("panic error: uri=%v, err=%v", c.Request.RequestURI, perr), false) // 打印堆栈错误
 	}
 }
 
-func createHandleFunc(mf MethodFunc, tag string) gin.HandlerFunc {
+func createHandleFunc(mf MethodFunc, tag string, status func(code int) int) gin.HandlerFunc {
 	return func(c *gin.Context) {
 
 		defer recoverHandleFunc(c)
@@ -50,108 +45,49 @@ func createHandleFunc(mf MethodFunc, tag string) gin.HandlerFunc {
 		var (
 			rdata []byte
 			wdata []byte
+			code  = api.UNKNOWN
 			rsp   interface{}
 			err   error
 		)
+		requestId := ensureRequestId(c.GetHeader(REQUEST_ID_HEADER))
+		c.Set(REQUEST_ID_KEY, requestId)
+		c.Header(REQUEST_ID_HEADER, requestId)
+		span := startSpan(c.GetHeader(TRACE_HEADER), tag, SPAN_KIND_SERVER)
+		if span != nil {
+			c.Set(TRACE_SPAN_KEY, span)
+		}
+		record := beginRequest(c.Request.Context(), TRANSPORT_HTTP, tag, span)
+		record.requestId = requestId
+		record.path, record.peer, record.agent = c.Request.URL.Path, c.ClientIP(), c.Request.UserAgent()
+		defer func() {
+			record.finish(code)
+		}()
 		rdata, err = c.GetRawData()
+		record.reqSize, record.payload = len(rdata), rdata
+		record.capture = c.GetHeader(CAPTURE_HEADER)
 		if err == nil {
-			rsp, err = mf(c, rdata)
-			if err == nil {
-				wdata, _ = json.Marshal(&api.Response{
-					Code: api.SUCCESS,
-					Data: rsp,
-					Tag:  tag,
-				})
-			} else {
-				log.Error(c, "%s execute service: %v", tag, err)
-				if ersp, ok := err.(*api.Response); ok {
-					wdata, _ = json.Marshal(ersp)
-				} else {
-					wdata, _ = json.Marshal(&api.Response{
-						Code: api.EXECUTE_SERVICE_ERROR,
-						Msg:  err.Error(),
-						Tag:  tag,
-					})
-				}
-			}
-		} else {
-			log.Error(c, "%s reading request: %v", tag, err)
-			wdata, _ = json.Marshal(&api.Response{
-				Code: api.READING_REQUEST_ERROR,
-				Msg:  err.Error(),
-				Tag:  tag,
+			rsp, err = invokeMethod(c, TRANSPORT_HTTP, tag, func() (interface{}, error) {
+				return mf(c, rdata)
 			})
-		}
-		c.Writer.Header()["Content-Type"] = api.JsonContentType
-		c.Writer.WriteHeader(http.StatusOK)
-		c.Writer.Write(wdata)
-	}
-}
-
-func createSocketFunc(upgrader *websocket.Upgrader, af MethodFunc, tag string) gin.HandlerFunc {
-	return func(c *gin.Context) {
-
-		defer recoverHandleFunc(c)
-
-		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-		if err != nil {
-			log.Error(c, "upgrade connection: %v", tag, err)
-			return
-		}
-		for {
-			var (
-				mtype int
-				rdata []byte
-				wdata []byte
-				rsp   interface{}
-				err   error
-			)
-			mtype, rdata, err = conn.ReadMessage()
 			if err != nil {
-				log.Error(c, "%s reading message: %v", tag, err)
-				return
-			}
-			rsp, err = af(c, rdata)
-			if err == nil {
-				wdata, _ = json.Marshal(&api.Response{
-					Code: api.SUCCESS,
-					Data: rsp,
-					Tag:  tag,
-				})
-			} else {
-				log.Error(c, "%s execute service: %v", tag, err)
-				if ersp, ok := err.(*api.Response); ok {
-					wdata, _ = json.Marshal(ersp)
-				} else {
-					wdata, _ = json.Marshal(&api.Response{
-						Code: api.EXECUTE_SERVICE_ERROR,
-						Msg:  err.Error(),
-						Tag:  tag,
-					})
-				}
+				log.Error(c, "%s execute service: %v", logTag(c, tag), err)
 			}
-			err = conn.WriteMessage(mtype, wdata)
-			if err != nil {
-				log.Error(c, "%s writing message: %v", tag, err)
-				return
+		} else {
+			log.Error(c, "%s reading request: %v", logTag(c, tag), err)
+			err = &Error{
+				Code:  api.READING_REQUEST_ERROR,
+				Msg:   err.Error(),
+				Tag:   tag,
+				cause: err,
 			}
 		}
+		reply := newSocketReply(c, nil, rsp, err, tag)
+		reply.stamp(c)
+		code = reply.Code
+		wdata, _ = json.Marshal(reply)
+		record.rspSize, record.response = len(wdata), wdata
+		c.Writer.Header()["Content-Type"] = api.JsonContentType
+		c.Writer.WriteHeader(status(code))
+		c.Writer.Write(wdata)
 	}
 }
-
-// 创建upgrader
-func createSocketUpgrader(conf *Config) *websocket.Upgrader {
-	upgrader := new(websocket.Upgrader)
-	if conf.WbskReadBufferSize != 0 {
-		upgrader.ReadBufferSize = conf.WbskReadBufferSize
-	}
-	if conf.WbskWriteBufferSize != 0 {
-		upgrader.WriteBufferSize = conf.WbskWriteBufferSize
-	}
-	if conf.WbskNotCheckOrigin {
-		upgrader.CheckOrigin = func(r *http.Request) bool {
-			return true
-		}
-	}
-	return upgrader
-}
\ No newline at end of file
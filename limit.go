@@ -0,0 +1,236 @@
+package apix
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/obase/api"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*websocket限制的终止原因*/
+const (
+	CLOSE_LIMIT_TOTAL = "too many connections"
+	CLOSE_LIMIT_IP    = "too many connections from ip"
+	CLOSE_LIMIT_USER  = "too many connections from user"
+	CLOSE_RATE_LIMIT  = "message rate exceeded"
+)
+
+var ErrTooManyConnections = errors.New(CLOSE_LIMIT_USER)
+
+/*websocket连接统计, 用于监控*/
+type SocketStats struct {
+	Active      int64  `json:"active"`      // 当前连接数
+	RejectTotal uint64 `json:"rejectTotal"` // 超出总连接数被拒绝的次数
+	RejectIP    uint64 `json:"rejectIP"`    // 超出单IP连接数被拒绝的次数
+	RejectUser  uint64 `json:"rejectUser"`  // 超出单用户连接数被拒绝的次数
+	RateLimited uint64 `json:"rateLimited"` // 超出消息速率被关闭的次数
+}
+
+/*连接数限制, 总数及按IP, userKey计数. userKey在升级时及之后每次Bind时计数*/
+type connLimiter struct {
+	sync.Mutex
+	total  int
+	byIP   map[string]int
+	byUser map[string]int
+	stats  SocketStats // 计数字段使用原子操作
+}
+
+var limits = &connLimiter{
+	byIP:   make(map[string]int),
+	byUser: make(map[string]int),
+}
+
+// 按IP计数所用的客户端地址. 默认取对端地址, X-Forwarded-For可由客户端伪造, 只在对端为可信代理时使用:
+// 从右向左跳过可信代理, 取第一个非可信代理的地址
+func socketClientIP(conf *Config, r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !trustedProxy(conf.WbskTrustedProxies, ip) {
+		return ip
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		if ip = hop; !trustedProxy(conf.WbskTrustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func trustedProxy(proxies []string, ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, p := range proxies {
+		if _, network, err := net.ParseCIDR(p); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+		} else if addr.Equal(net.ParseIP(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// 启动时校验可信代理的格式
+func validateTrustedProxies(conf *Config) error {
+	for _, p := range conf.WbskTrustedProxies {
+		if _, _, err := net.ParseCIDR(p); err != nil && net.ParseIP(p) == nil {
+			return errors.New("invalid websocket trusted proxy: " + p)
+		}
+	}
+	return nil
+}
+
+// 占用连接数, 超出限制返回关闭码与原因
+func (l *connLimiter) acquire(conf *Config, ip string, user string) (int, string) {
+	l.Lock()
+	defer l.Unlock()
+	switch {
+	case conf.WbskMaxConnections > 0 && l.total >= conf.WbskMaxConnections:
+		atomic.AddUint64(&l.stats.RejectTotal, 1)
+		return websocket.CloseTryAgainLater, CLOSE_LIMIT_TOTAL
+	case conf.WbskMaxConnectionsPerIP > 0 && l.byIP[ip] >= conf.WbskMaxConnectionsPerIP:
+		atomic.AddUint64(&l.stats.RejectIP, 1)
+		return websocket.ClosePolicyViolation, CLOSE_LIMIT_IP
+	case conf.WbskMaxConnectionsPerUser > 0 && user != "" && l.byUser[user] >= conf.WbskMaxConnectionsPerUser:
+		atomic.AddUint64(&l.stats.RejectUser, 1)
+		return websocket.ClosePolicyViolation, CLOSE_LIMIT_USER
+	}
+	l.total++
+	l.byIP[ip]++
+	l.acquireUser(user)
+	atomic.AddInt64(&l.stats.Active, 1)
+	return 0, ""
+}
+
+// 绑定用户时改按新userKey计数, 超出限制返回关闭码与原因. 会话已释放则不再计数
+func (l *connLimiter) rebind(s *Session, user string) (int, string) {
+	l.Lock()
+	defer l.Unlock()
+	if s.released || user == s.limitKey {
+		return 0, ""
+	}
+	if s.conf.WbskMaxConnectionsPerUser > 0 && user != "" && l.byUser[user] >= s.conf.WbskMaxConnectionsPerUser {
+		atomic.AddUint64(&l.stats.RejectUser, 1)
+		return websocket.ClosePolicyViolation, CLOSE_LIMIT_USER
+	}
+	l.releaseUser(s.limitKey)
+	l.acquireUser(user)
+	s.limitKey = user
+	return 0, ""
+}
+
+// 恢复会话时新连接继承原会话的用户计数, 不受限制
+func (l *connLimiter) inherit(prev *Session, s *Session) {
+	l.Lock()
+	defer l.Unlock()
+	if s.released || s.limitKey != "" || prev.limitKey == "" {
+		return
+	}
+	s.limitKey = prev.limitKey
+	if prev.released {
+		l.acquireUser(s.limitKey)
+	} else {
+		prev.limitKey = "" // 计数转移到新连接
+	}
+}
+
+func (l *connLimiter) release(s *Session) {
+	l.Lock()
+	defer l.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	l.total--
+	if l.byIP[s.ip]--; l.byIP[s.ip] <= 0 {
+		delete(l.byIP, s.ip)
+	}
+	l.releaseUser(s.limitKey)
+	atomic.AddInt64(&l.stats.Active, -1)
+}
+
+// 调用者需持有锁
+func (l *connLimiter) acquireUser(user string) {
+	if user != "" {
+		l.byUser[user]++
+	}
+}
+
+func (l *connLimiter) releaseUser(user string) {
+	if user != "" {
+		if l.byUser[user]--; l.byUser[user] <= 0 {
+			delete(l.byUser, user)
+		}
+	}
+}
+
+/*当前websocket连接统计*/
+func GetSocketStats() SocketStats {
+	return SocketStats{
+		Active:      atomic.LoadInt64(&limits.stats.Active),
+		RejectTotal: atomic.LoadUint64(&limits.stats.RejectTotal),
+		RejectIP:    atomic.LoadUint64(&limits.stats.RejectIP),
+		RejectUser:  atomic.LoadUint64(&limits.stats.RejectUser),
+		RateLimited: atomic.LoadUint64(&limits.stats.RateLimited),
+	}
+}
+
+// 连接统计的管理接口
+func serveSocketStats(w http.ResponseWriter, r *http.Request) {
+	data, _ := json.Marshal(GetSocketStats())
+	w.Header()["Content-Type"] = api.JsonContentType
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+/*令牌桶, 只由连接的读循环使用, 不需要加锁*/
+type tokenBucket struct {
+	rate   float64 // 每秒补充的令牌数
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = int(rate)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
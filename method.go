@@ -3,18 +3,26 @@ package apix
 import (
 	"context"
 	"github.com/gin-gonic/gin"
+	"time"
 )
 
 /*方法处理原型*/
 type MethodFunc func(ctx context.Context, rdata []byte) (interface{}, error)
 
 type Method struct {
-	tag          string
-	adapter      MethodFunc        // 对应方法的AdapterFunc
-	handlePath   string            // 对应方法的Handler path
-	handleFilter []gin.HandlerFunc // 对应方法的Handler Filter
-	socketPath   string            // 对应方法的Socket path
-	socketFilter []gin.HandlerFunc // 对应方法的Handler Filter
+	tag             string
+	adapter         MethodFunc        // 对应方法的AdapterFunc
+	handlePath      string            // 对应方法的Handler path
+	handleFilter    []gin.HandlerFunc // 对应方法的Handler Filter
+	socketPath      string            // 对应方法的Socket path
+	socketFilter    []gin.HandlerFunc // 对应方法的Handler Filter
+	socketProtocols []string          // 对应方法的Socket子协议, 为空使用wbskSubprotocols
+	socketOrigins   []string          // 对应方法允许的Socket来源, 为空使用wbskAllowOrigins
+	onConnect       []SocketConnectFunc
+	onMessage       []SocketMessageFunc
+	onClose         []SocketCloseFunc
+	onTopic         []SocketTopicFunc
+	slowThreshold   time.Duration // 慢请求阈值, 为0使用slowThreshold配置
 }
 
 func (gm *Method) HandlePath(path string) {
@@ -32,3 +40,31 @@ func (gm *Method) SocketPath(path string) {
 func (gm *Method) SocketFilter(hf gin.HandlerFunc) {
 	gm.socketFilter = append(gm.socketFilter, hf)
 }
+
+func (gm *Method) SocketProtocols(protocols ...string) {
+	gm.socketProtocols = protocols
+}
+
+func (gm *Method) SocketOrigins(origins ...string) {
+	gm.socketOrigins = origins
+}
+
+func (gm *Method) OnConnect(f SocketConnectFunc) {
+	gm.onConnect = append(gm.onConnect, f)
+}
+
+func (gm *Method) OnMessage(f SocketMessageFunc) {
+	gm.onMessage = append(gm.onMessage, f)
+}
+
+func (gm *Method) OnClose(f SocketCloseFunc) {
+	gm.onClose = append(gm.onClose, f)
+}
+
+func (gm *Method) OnTopic(f SocketTopicFunc) {
+	gm.onTopic = append(gm.onTopic, f)
+}
+
+func (gm *Method) SlowThreshold(d time.Duration) {
+	gm.slowThreshold = d
+}
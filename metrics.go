@@ -0,0 +1,215 @@
+package apix
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+内置指标, 以Prometheus文本格式输出, 不依赖Prometheus客户端:
+1. apix_requests_total, apix_request_duration_seconds: 按transport(http/socket/grpc), method(方法tag)及code(响应代码)统计
+2. apix_inflight_requests: 按transport统计正在执行的请求
+3. apix_panics_total: 按transport及method统计方法中恢复的panic
+4. apix_websocket_*: 连接数及限制统计
+*/
+const (
+	TRANSPORT_HTTP   = "http"
+	TRANSPORT_SOCKET = "socket"
+	TRANSPORT_GRPC   = "grpc"
+
+	METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	requestsTotal   = newMetricVec("apix_requests_total", "Total number of requests.", "counter", nil, "transport", "method", "code")
+	requestDuration = newMetricVec("apix_request_duration_seconds", "Request latency in seconds.", "histogram", defaultBuckets, "transport", "method", "code")
+	inflightGauge   = newMetricVec("apix_inflight_requests", "Number of requests being served.", "gauge", nil, "transport")
+	panicsTotal     = newMetricVec("apix_panics_total", "Total number of panics recovered in methods.", "counter", nil, "transport", "method")
+)
+
+/*指标族, 按标签值区分序列*/
+type metricVec struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64 // 仅histogram
+	mu      sync.RWMutex
+	series  map[string]*metricSeries
+}
+
+type metricSeries struct {
+	sync.Mutex
+	values []string
+	value  float64  // counter或gauge的值
+	count  uint64   // histogram的样本数
+	sum    float64  // histogram的样本和
+	counts []uint64 // histogram各桶的样本数(非累计)
+}
+
+func newMetricVec(name string, help string, typ string, buckets []float64, labels ...string) *metricVec {
+	return &metricVec{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*metricSeries),
+	}
+}
+
+func (m *metricVec) with(values ...string) *metricSeries {
+	key := strings.Join(values, "\xff")
+	m.mu.RLock()
+	s, ok := m.series[key]
+	m.mu.RUnlock()
+	if ok {
+		return s
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok = m.series[key]; !ok {
+		s = &metricSeries{values: values}
+		if m.buckets != nil {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metricVec) add(delta float64, values ...string) {
+	s := m.with(values...)
+	s.Lock()
+	s.value += delta
+	s.Unlock()
+}
+
+func (m *metricVec) observe(v float64, values ...string) {
+	s := m.with(values...)
+	s.Lock()
+	s.count++
+	s.sum += v
+	if i := sort.SearchFloat64s(m.buckets, v); i < len(m.buckets) {
+		s.counts[i]++
+	}
+	s.Unlock()
+}
+
+// 按标签值排序输出
+func (m *metricVec) write(w *bufio.Writer) {
+	m.mu.RLock()
+	list := make([]*metricSeries, 0, len(m.series))
+	for _, s := range m.series {
+		list = append(list, s)
+	}
+	m.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return strings.Join(list[i].values, "\xff") < strings.Join(list[j].values, "\xff")
+	})
+
+	writeMetricHeader(w, m.name, m.help, m.typ)
+	for _, s := range list {
+		s.Lock()
+		if m.typ != "histogram" {
+			writeMetricSample(w, m.name, m.labels, s.values, "", "", s.value)
+		} else {
+			var cumulative uint64
+			for i, le := range m.buckets {
+				cumulative += s.counts[i]
+				writeMetricSample(w, m.name+"_bucket", m.labels, s.values, "le", formatFloat(le), float64(cumulative))
+			}
+			writeMetricSample(w, m.name+"_bucket", m.labels, s.values, "le", "+Inf", float64(s.count))
+			writeMetricSample(w, m.name+"_sum", m.labels, s.values, "", "", s.sum)
+			writeMetricSample(w, m.name+"_count", m.labels, s.values, "", "", float64(s.count))
+		}
+		s.Unlock()
+	}
+}
+
+func writeMetricHeader(w *bufio.Writer, name string, help string, typ string) {
+	w.WriteString("# HELP " + name + " " + help + "\n")
+	w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+func writeMetricSample(w *bufio.Writer, name string, labels []string, values []string, extraLabel string, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l + `="` + escapeLabel(values[i]) + `"`)
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraLabel + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// 记录一次请求的指标
+func observeRequest(transport string, tag string, code int, latency time.Duration) {
+	c := strconv.Itoa(code)
+	requestsTotal.add(1, transport, tag, c)
+	requestDuration.observe(latency.Seconds(), transport, tag, c)
+}
+
+/*以Prometheus文本格式输出全部指标*/
+func WriteMetrics(out io.Writer) error {
+	w := bufio.NewWriter(out)
+	requestsTotal.write(w)
+	requestDuration.write(w)
+	inflightGauge.write(w)
+	panicsTotal.write(w)
+
+	stats := GetSocketStats()
+	writeMetricHeader(w, "apix_websocket_connections", "Number of active websocket connections.", "gauge")
+	writeMetricSample(w, "apix_websocket_connections", nil, nil, "", "", float64(stats.Active))
+	writeMetricHeader(w, "apix_websocket_rejected_total", "Total number of websocket connections rejected by limits.", "counter")
+	writeMetricSample(w, "apix_websocket_rejected_total", []string{"reason"}, []string{"total"}, "", "", float64(stats.RejectTotal))
+	writeMetricSample(w, "apix_websocket_rejected_total", []string{"reason"}, []string{"ip"}, "", "", float64(stats.RejectIP))
+	writeMetricSample(w, "apix_websocket_rejected_total", []string{"reason"}, []string{"user"}, "", "", float64(stats.RejectUser))
+	writeMetricHeader(w, "apix_websocket_rate_limited_total", "Total number of websocket connections closed by message rate limit.", "counter")
+	writeMetricSample(w, "apix_websocket_rate_limited_total", nil, nil, "", "", float64(stats.RateLimited))
+	return w.Flush()
+}
+
+// 指标接口
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+	w.WriteHeader(http.StatusOK)
+	WriteMetrics(w)
+}
@@ -0,0 +1,35 @@
+package apix
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	// 指标是全局累计的, 每次运行使用不同的tag, 保证-count=N时计数仍为1
+	tag := "Test.Metrics" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	beginRequest(context.Background(), TRANSPORT_HTTP, tag, nil).finish(0)
+	beginRequest(context.Background(), TRANSPORT_HTTP, tag, nil).finish(1001)
+
+	var buf bytes.Buffer
+	if err := WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		`apix_requests_total{transport="http",method="` + tag + `",code="0"} 1`,
+		`apix_requests_total{transport="http",method="` + tag + `",code="1001"} 1`,
+		`apix_request_duration_seconds_bucket{transport="http",method="` + tag + `",code="0",le="+Inf"} 1`,
+		`apix_request_duration_seconds_count{transport="http",method="` + tag + `",code="1001"} 1`,
+		`apix_inflight_requests{transport="http"} 0`,
+		`# TYPE apix_websocket_connections gauge`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package apix
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+多路复用的websocket入口:
+1. 每帧通过method指定目标方法的tag, 如{"method":"IPlayer.Add","id":1,"data":{...}}
+2. 每个连接首次调用某方法时在升级请求上执行该方法的groupFilter与socketFilter, 过滤器中止则拒绝该方法
+3. 方法的OnConnect钩子在首次调用时执行, 拒绝则该方法返回METHOD_NOT_ALLOWED, 不关闭连接. OnClose钩子只对已连接的方法执行
+4. 未知方法返回METHOD_NOT_FOUND错误
+5. 入口协商wbskSubprotocols与各方法SocketProtocols的并集, 指定了SocketProtocols的方法只接受其中协议的连接(未协商视为json), 否则返回METHOD_NOT_ALLOWED
+6. 指定了SocketOrigins的方法在首次调用时校验升级请求的Origin, 不匹配返回METHOD_NOT_ALLOWED. 连接本身仍须通过入口的来源检查(wbskAllowOrigins)
+*/
+type socketMux struct {
+	methods   map[string]*socketMuxMethod
+	filters   *gin.Engine // 执行各方法的过滤器链
+	protocols []string    // 各方法单独指定的子协议, 按注册顺序
+}
+
+type socketMuxMethod struct {
+	path      string // 过滤器链在filters中的路径
+	adapter   MethodFunc
+	filter    bool // 是否有过滤器
+	hooks     *socketHooks
+	protocols []string // 方法允许的子协议, 为空不限制
+	origins   []string // 方法允许的来源, 为空不限制
+}
+
+// 每个连接缓存的方法授权结果
+type socketMuxAllow struct {
+	fc  *gin.Context
+	err error // 过滤器或OnConnect拒绝的原因
+}
+
+// 过滤器执行结果, 通过request context传递
+type socketMuxResult struct {
+	origin *gin.Context
+	result *gin.Context
+}
+
+type socketMuxKey struct{}
+
+func newSocketMux(services []*Service) *socketMux {
+	mux := &socketMux{
+		methods: make(map[string]*socketMuxMethod),
+		filters: gin.New(),
+	}
+	for _, smeta := range services {
+		for _, mmeta := range smeta.methods {
+			path := "/" + strconv.Itoa(len(mux.methods))
+			chain := make([]gin.HandlerFunc, 0, len(smeta.groupFilter)+len(mmeta.socketFilter)+2)
+			chain = append(chain, copyMuxKeys)
+			chain = append(chain, smeta.groupFilter...)
+			chain = append(chain, mmeta.socketFilter...)
+			chain = append(chain, saveMuxResult)
+			mux.filters.GET(path, chain...)
+			for _, p := range mmeta.socketProtocols {
+				if !containsString(mux.protocols, p) {
+					mux.protocols = append(mux.protocols, p)
+				}
+			}
+			hooks := newSocketHooks(smeta, mmeta)
+			mux.methods[mmeta.tag] = &socketMuxMethod{
+				path:      path,
+				adapter:   hooks.message(mmeta.adapter),
+				filter:    len(smeta.groupFilter)+len(mmeta.socketFilter) > 0,
+				hooks:     hooks,
+				protocols: mmeta.socketProtocols,
+				origins:   mmeta.socketOrigins,
+			}
+		}
+	}
+	return mux
+}
+
+// 入口协商的子协议: 全局配置在前, 再追加各方法单独指定的子协议
+func (mux *socketMux) subprotocols(conf *Config) []string {
+	ret := append([]string(nil), conf.WbskSubprotocols...)
+	for _, p := range mux.protocols {
+		if !containsString(ret, p) {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// 连接协商的子协议是否被方法接受
+func (m *socketMuxMethod) accept(subprotocol string) bool {
+	if len(m.protocols) == 0 {
+		return true
+	}
+	if subprotocol == "" {
+		subprotocol = SUBPROTOCOL_JSON
+	}
+	return containsString(m.protocols, subprotocol)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 启动时校验方法tag, 多路复用按tag分发, 重复则先注册的方法不可达
+func validateMuxTags(conf *Config, services []*Service) error {
+	if conf.WbskMuxPath == "" {
+		return nil
+	}
+	var dups []string
+	tags := make(map[string]int)
+	for _, smeta := range services {
+		for _, mmeta := range smeta.methods {
+			if tags[mmeta.tag]++; tags[mmeta.tag] == 2 {
+				dups = append(dups, mmeta.tag)
+			}
+		}
+	}
+	if len(dups) > 0 {
+		return fmt.Errorf("duplicate websocket mux tags: %v", strings.Join(dups, ", "))
+	}
+	return nil
+}
+
+// 过滤器链开始: 复制升级请求上的Keys, 包括会话. 升级请求的Keys可能被并发的消息修改, 需持有读锁.
+// 路由已完成, 恢复升级请求的url, 过滤器及访问日志, 捕获, span记录看到的是入口路径而非过滤器链路径
+func copyMuxKeys(fc *gin.Context) {
+	holder := fc.Request.Context().Value(socketMuxKey{}).(*socketMuxResult)
+	origin := holder.origin
+	fc.Request.URL = origin.Request.URL
+	keys := make(map[string]interface{})
+	if origin.KeysMutex != nil {
+		origin.KeysMutex.RLock()
+	}
+	for k, v := range origin.Keys {
+		keys[k] = v
+	}
+	if origin.KeysMutex != nil {
+		origin.KeysMutex.RUnlock()
+	}
+	for k, v := range keys {
+		fc.Set(k, v)
+	}
+}
+
+// 过滤器链结束: 保存过滤后的context供方法使用
+func saveMuxResult(fc *gin.Context) {
+	holder := fc.Request.Context().Value(socketMuxKey{}).(*socketMuxResult)
+	holder.result = fc.Copy()
+}
+
+// 在升级请求上执行方法的过滤器链, 过滤器中止则返回nil
+func (mux *socketMux) authorize(c *gin.Context, m *socketMuxMethod) *gin.Context {
+	if !m.filter {
+		return c
+	}
+	holder := &socketMuxResult{origin: c}
+	req := c.Request.WithContext(context.WithValue(c.Request.Context(), socketMuxKey{}, holder))
+	url := *c.Request.URL
+	url.Path = m.path
+	req.URL = &url
+	mux.filters.ServeHTTP(&discardResponseWriter{header: make(http.Header)}, req)
+	return holder.result
+}
+
+func createSocketMuxFunc(upgrader *websocket.Upgrader, mux *socketMux, conf *Config) gin.HandlerFunc {
+	concurrency := conf.WbskConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	checkers := make(map[string]func(r *http.Request) bool) // 单独指定了来源的方法
+	for tag, m := range mux.methods {
+		if len(m.origins) > 0 {
+			checkers[tag] = createOriginChecker(conf, m.origins)
+		}
+	}
+	return func(c *gin.Context) {
+
+		defer recoverHandleFunc(c)
+
+		sc := openSession(c, upgrader, conf, conf.WbskMuxPath)
+		if sc == nil {
+			return
+		}
+		if conf.WbskResumeWindow > 0 {
+			attachResume(c, sc, conf) // 多路复用入口的OnConnect按方法执行, 不影响连接
+		}
+
+		var (
+			amux   sync.Mutex
+			allows = make(map[string]*socketMuxAllow) // 每个连接缓存各方法的授权结果
+		)
+		defer func() {
+			closeSession(sc)
+			amux.Lock()
+			defer amux.Unlock()
+			for tag, allow := range allows {
+				if allow.err == nil {
+					mux.methods[tag].hooks.close(allow.fc, sc)
+				}
+			}
+			sc.finish()
+		}()
+
+		serveSocketConcurrent(c, sc, func(frame *socketFrame) (*gin.Context, MethodFunc, string, *socketHooks, error) {
+			m, ok := mux.methods[frame.Method]
+			if !ok {
+				return nil, nil, "", nil, NewError(METHOD_NOT_FOUND, "method not found: %v", frame.Method).WithTag(frame.Method)
+			}
+			if !m.accept(sc.conn.Subprotocol()) {
+				return nil, nil, "", nil, NewError(METHOD_NOT_ALLOWED, "method not allowed: %v: subprotocol %q", frame.Method, sc.conn.Subprotocol()).WithTag(frame.Method)
+			}
+			amux.Lock()
+			allow, ok := allows[frame.Method]
+			if !ok {
+				allow = &socketMuxAllow{}
+				if check, ok := checkers[frame.Method]; ok && !check(c.Request) {
+					allow.err = NewError(METHOD_NOT_ALLOWED, "method not allowed: %v: origin %q", frame.Method, c.GetHeader("Origin")).WithTag(frame.Method)
+				} else if allow.fc = mux.authorize(c, m); allow.fc == nil {
+					allow.err = NewError(METHOD_NOT_ALLOWED, "method not allowed: %v", frame.Method).WithTag(frame.Method)
+				} else if err := m.hooks.connect(allow.fc, sc); err != nil {
+					allow.err = NewError(METHOD_NOT_ALLOWED, "method not allowed: %v: %v", frame.Method, err).WithTag(frame.Method)
+				}
+				allows[frame.Method] = allow
+			}
+			amux.Unlock()
+			if allow.err != nil {
+				return nil, nil, "", nil, allow.err
+			}
+			return allow.fc, m.adapter, frame.Method, m.hooks, nil
+		}, conf.WbskMuxPath, concurrency, conf.WbskTopicOps)
+	}
+}
+
+/*丢弃过滤器的输出, 过滤器只用于鉴权*/
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(bs []byte) (int, error) {
+	return len(bs), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(status int) {
+}
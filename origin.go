@@ -0,0 +1,82 @@
+package apix
+
+import (
+	"github.com/obase/log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+websocket来源校验, 规则如下:
+1. 方法的SocketOrigins非空则按方法名单匹配, 优先于全局配置
+2. wbskNotCheckOrigin为true则接受全部来源, 兼容旧配置
+3. wbskAllowOrigins非空则按名单匹配
+4. 否则与gorilla默认一样检查Origin与Host同源
+5. 请求没有Origin头(非浏览器客户端)时接受, 拒绝的来源都输出日志
+名单格式: "*"匹配全部, "https://www.example.com"匹配scheme与host, "*.example.com"匹配任意scheme与端口的子域名(不含example.com本身), "*.example.com:8443"只匹配该端口
+*/
+func createOriginChecker(conf *Config, origins []string) func(r *http.Request) bool {
+	if len(origins) == 0 {
+		if conf.WbskNotCheckOrigin {
+			return func(r *http.Request) bool {
+				return true
+			}
+		}
+		origins = conf.WbskAllowOrigins
+	}
+	match := matchOrigin
+	if len(origins) == 0 {
+		match = sameOrigin
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		if match(r, origin, origins) {
+			return true
+		}
+		log.Warn(nil, "websocket origin rejected: %v %v", origin, r.URL.Path)
+		return false
+	}
+}
+
+// 与gorilla默认检查一致: Origin的host与请求的Host相同
+func sameOrigin(r *http.Request, origin string, patterns []string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// 匹配来源名单
+func matchOrigin(r *http.Request, origin string, patterns []string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme, host, hostname := strings.ToLower(u.Scheme), strings.ToLower(u.Host), strings.ToLower(u.Hostname())
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if p == "*" {
+			return true
+		}
+		if pos := strings.Index(p, "://"); pos >= 0 {
+			if p[:pos] != scheme {
+				continue
+			}
+			p = p[pos+3:]
+		}
+		if strings.HasPrefix(p, "*.") {
+			if strings.Contains(p, ":") {
+				if strings.HasSuffix(host, p[1:]) {
+					return true
+				}
+			} else if strings.HasSuffix(hostname, p[1:]) {
+				return true
+			}
+		} else if p == host {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package apix
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchOrigin(t *testing.T) {
+	patterns := []string{"https://www.example.com", "*.example.org", "*.example.net:8443"}
+	cases := map[string]bool{
+		"https://www.example.com":      true,
+		"http://www.example.com":       false,
+		"https://api.example.org":      true,
+		"http://a.b.example.org":       true,
+		"https://api.example.org:8443": true,
+		"https://example.org":          false,
+		"https://evilexample.org":      false,
+		"https://www.example.com:8443": false,
+		"https://api.example.net:8443": true,
+		"https://api.example.net":      false,
+		"https://api.example.net:9443": false,
+		"null":                         false,
+	}
+	for origin, want := range cases {
+		if got := matchOrigin(nil, origin, patterns); got != want {
+			t.Errorf("matchOrigin(%q) = %v, want %v", origin, got, want)
+		}
+	}
+}
+
+func TestOriginCheckerPrecedence(t *testing.T) {
+	cases := []struct {
+		name    string
+		conf    *Config
+		origins []string
+		origin  string
+		want    bool
+	}{
+		{"method list overrides not-check", &Config{WbskNotCheckOrigin: true}, []string{"https://a.com"}, "https://b.com", false},
+		{"method list allows", &Config{WbskNotCheckOrigin: true}, []string{"https://a.com"}, "https://a.com", true},
+		{"not-check without method list", &Config{WbskNotCheckOrigin: true}, nil, "https://b.com", true},
+		{"global list", &Config{WbskAllowOrigins: []string{"*.a.com"}}, nil, "https://x.a.com:8080", true},
+		{"method list overrides global", &Config{WbskAllowOrigins: []string{"*.a.com"}}, []string{"https://b.com"}, "https://x.a.com", false},
+		{"same host", &Config{}, nil, "http://example.com", true},
+		{"cross host", &Config{}, nil, "http://evil.com", false},
+		{"no origin", &Config{}, nil, "", true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "http://example.com/ws", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if got := createOriginChecker(c.conf, c.origins)(r); got != c.want {
+			t.Errorf("%v: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
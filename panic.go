@@ -0,0 +1,19 @@
+package apix
+
+import (
+	"context"
+	"fmt"
+	"github.com/obase/log"
+)
+
+// 执行方法, 将panic转换为PANIC_ERROR响应, 打印堆栈并计数. http返回错误响应, websocket继续处理下一条消息, grpc返回codes.Internal
+func invokeMethod(ctx context.Context, transport string, tag string, fn func() (interface{}, error)) (rsp interface{}, err error) {
+	defer func() {
+		if perr := recover(); perr != nil {
+			panicsTotal.add(1, transport, tag)
+			log.ErrorStack(ctx, fmt.Errorf("%s panic error: %v", logTag(ctx, tag), perr), false) // 打印堆栈错误
+			rsp, err = nil, WrapError(fmt.Errorf("panic: %v", perr), PANIC_ERROR, "")
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,73 @@
+package apix
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPanicHttp(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.POST("/test", createHandleFunc(func(ctx context.Context, rdata []byte) (interface{}, error) {
+		panic("boom")
+	}, "Test.Panic", createHttpStatusFunc(mergeConfig(&Config{}))))
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/test", strings.NewReader("{}")))
+	var reply struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusInternalServerError || reply.Code != PANIC_ERROR || strings.Contains(reply.Msg, "boom") {
+		t.Fatalf("unexpected response: %v %s", w.Code, w.Body.Bytes())
+	}
+}
+
+func TestPanicSocket(t *testing.T) {
+	conn, closef := newSocketTestServer(t, &Config{}, func(ctx context.Context, rdata []byte) (interface{}, error) {
+		if string(rdata) == `"panic"` {
+			panic("boom")
+		}
+		return "ok", nil
+	})
+	defer closef()
+
+	var reply struct {
+		Code int    `json:"code"`
+		Data string `json:"data"`
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(`"panic"`))
+	if err := conn.ReadJSON(&reply); err != nil || reply.Code != PANIC_ERROR {
+		t.Fatalf("unexpected reply: %+v, %v", reply, err)
+	}
+	// 连接继续处理下一条消息
+	conn.WriteMessage(websocket.TextMessage, []byte(`"next"`))
+	if err := conn.ReadJSON(&reply); err != nil || reply.Code != 0 || reply.Data != "ok" {
+		t.Fatalf("unexpected reply: %+v, %v", reply, err)
+	}
+}
+
+func TestPanicGrpc(t *testing.T) {
+	interceptor := createUnaryServerInterceptor(createGrpcStatusFunc(mergeConfig(&Config{})))
+	_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/test.Test/Panic"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("boom")
+	})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e, ok := FromGrpcError(err).(*Error); !ok || e.Code != PANIC_ERROR {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package apix
+
+import (
+	"context"
+	"time"
+)
+
+/*单次请求的记录, 请求结束时统一输出指标, span及访问日志*/
+type requestRecord struct {
+	transport string
+	tag       string // 方法tag, grpc为完整方法名
+	path      string
+	peer      string
+	agent     string
+	requestId string
+	reqSize   int
+	rspSize   int
+	payload   interface{} // 请求数据, 用于慢请求记录及捕获
+	response  interface{} // 响应数据, 用于捕获
+	capture   string      // 捕获触发头
+	start     time.Time
+	span      *Span
+	slow      *slowWatch
+}
+
+// 记录请求开始, 请求结束时以响应代码调用finish. ctx为请求的context, 慢请求标签在其pprof标签之上追加
+func beginRequest(ctx context.Context, transport string, tag string, span *Span) *requestRecord {
+	inflightGauge.add(1, transport)
+	addInflightMethod(transport, tag, 1)
+	span.SetAttribute("apix.transport", transport)
+	return &requestRecord{
+		transport: transport,
+		tag:       tag,
+		start:     time.Now(),
+		span:      span,
+		slow:      startSlowWatch(ctx, transport, tag),
+	}
+}
+
+func (r *requestRecord) finish(code int) {
+	latency := time.Since(r.start)
+	inflightGauge.add(-1, r.transport)
+	addInflightMethod(r.transport, r.tag, -1)
+	observeRequest(r.transport, r.tag, code, latency)
+	r.span.finish(code)
+	writeAccessLog(r, code, latency)
+	r.slow.stop(r, code, latency)
+	writeCapture(r, code)
+}
+
+// 携带请求id与span的context, 供请求结束后输出的日志使用
+func (r *requestRecord) context() context.Context {
+	ctx := context.WithValue(context.Background(), REQUEST_ID_KEY, r.requestId)
+	if r.span != nil {
+		ctx = context.WithValue(ctx, TRACE_SPAN_KEY, r.span)
+	}
+	return ctx
+}
@@ -0,0 +1,80 @@
+package apix
+
+import (
+	"context"
+	"google.golang.org/grpc/metadata"
+	"net/http"
+)
+
+/*
+请求id, 用于关联客户端报告与服务端日志:
+1. http从X-Request-Id头, grpc从x-request-id元数据, websocket从帧的requestId字段读取, 缺失或非法则生成
+2. http响应头及grpc响应头元数据回传请求id, 配置requestIdResponse后响应中携带requestId
+3. 错误日志, 访问日志与慢请求日志附带请求id, 日志的ctx同时携带请求id与span, UnaryClientInterceptor及InjectRequestId向下游转发
+*/
+const (
+	REQUEST_ID_HEADER   = "X-Request-Id"
+	REQUEST_ID_METADATA = "x-request-id"      // grpc元数据的key
+	REQUEST_ID_KEY      = "_apix_request_id_" // context中保存请求id的key
+
+	maxRequestIdLength = 128
+)
+
+var requestIdResponse bool // 响应中是否携带requestId
+
+func setupRequestId(conf *Config) {
+	requestIdResponse = conf.RequestIdResponse
+}
+
+// 沿用上游请求id, 缺失或非法则生成. 只接受可见ASCII字符, 避免日志注入
+func ensureRequestId(id string) string {
+	if id == "" || len(id) > maxRequestIdLength {
+		return newTraceId(16)
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return newTraceId(16)
+		}
+	}
+	return id
+}
+
+/*当前请求的请求id*/
+func RequestId(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	if id, ok := ctx.Value(REQUEST_ID_KEY).(string); ok {
+		return id
+	}
+	return ""
+}
+
+/*向下游http请求转发请求id*/
+func InjectRequestId(ctx context.Context, header http.Header) {
+	if id := RequestId(ctx); id != "" {
+		header.Set(REQUEST_ID_HEADER, id)
+	}
+}
+
+// grpc元数据中的请求id
+func grpcRequestId(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vals := md.Get(REQUEST_ID_METADATA); len(vals) > 0 {
+			return vals[0]
+		}
+	}
+	return ""
+}
+
+// 日志前缀, 关联请求id与trace id
+func logTag(ctx context.Context, tag string) string {
+	ret := tag
+	if id := RequestId(ctx); id != "" {
+		ret += " [req=" + id + "]"
+	}
+	if traceId := TraceId(ctx); traceId != "" {
+		ret += " [trace=" + traceId + "]"
+	}
+	return ret
+}
@@ -0,0 +1,71 @@
+package apix
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIdHttp(t *testing.T) {
+	requestIdResponse = true
+	defer func() {
+		requestIdResponse = false
+	}()
+
+	var inner string
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.POST("/test", createHandleFunc(func(ctx context.Context, rdata []byte) (interface{}, error) {
+		inner = RequestId(ctx)
+		return nil, nil
+	}, "Test.RequestId", func(code int) int { return http.StatusOK }))
+
+	for _, given := range []string{"client-id-1", "bad\nid", ""} {
+		req := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader("{}"))
+		req.Header.Set(REQUEST_ID_HEADER, given)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+
+		var reply struct {
+			RequestId string `json:"requestId"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &reply)
+		header := w.Header().Get(REQUEST_ID_HEADER)
+		if header == "" || header != inner || reply.RequestId != inner {
+			t.Fatalf("unexpected request id: header=%v reply=%v inner=%v", header, reply.RequestId, inner)
+		}
+		if (given == "client-id-1") != (inner == given) {
+			t.Fatalf("request id %q should not be accepted as %q", given, inner)
+		}
+	}
+}
+
+func TestRequestIdSocket(t *testing.T) {
+	requestIdResponse = true
+	defer func() {
+		requestIdResponse = false
+	}()
+
+	conn, closef := newSocketTestServer(t, &Config{WbskConcurrency: 2}, func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return RequestId(ctx), nil
+	})
+	defer closef()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":1,"requestId":"client-id-2","data":{}}`))
+	var reply struct {
+		Data      string `json:"data"`
+		RequestId string `json:"requestId"`
+	}
+	if err := conn.ReadJSON(&reply); err != nil || reply.Data != "client-id-2" || reply.RequestId != "client-id-2" {
+		t.Fatalf("unexpected reply: %+v, %v", reply, err)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":2,"data":{}}`))
+	if err := conn.ReadJSON(&reply); err != nil || reply.Data == "" || reply.RequestId != reply.Data {
+		t.Fatalf("unexpected reply: %+v, %v", reply, err)
+	}
+}
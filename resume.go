@@ -0,0 +1,230 @@
+package apix
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/obase/api"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+可恢复会话, 配置wbskResumeWindow后启用:
+1. 连接建立后服务端先发送tag为apix.resume的消息, data包含id, token, seq及是否恢复成功
+2. 推送与广播消息带递增的seq, 每个会话缓存最近wbskResumeBuffer条
+3. 断开后会话保留wbskResumeWindow, 期间的推送与广播继续缓存
+4. 客户端重连时通过resume_token与resume_seq参数恢复, OnConnect通过后服务端补发seq之后的消息. 会话id, 绑定用户, 主题与状态保持不变, OnConnect中Set/Bind的值优先
+5. 响应消息不带seq, 也不会补发
+*/
+const (
+	RESUME_TAG         = "apix.resume"  // 连接建立后的会话消息tag
+	RESUME_TOKEN_PARAM = "resume_token" // 重连参数: 会话token
+	RESUME_SEQ_PARAM   = "resume_seq"   // 重连参数: 已收到的最大seq
+)
+
+/*连接建立后的会话消息*/
+type ResumeInfo struct {
+	Id      string `json:"id"`
+	Token   string `json:"token"`
+	Seq     uint64 `json:"seq"`            // 服务端当前最大seq
+	Resumed bool   `json:"resumed"`        // 是否恢复了原会话
+	Lost    bool   `json:"lost,omitempty"` // 部分消息已超出缓存, 无法补发
+}
+
+/*可恢复会话的发送记录, 在同一会话先后的多个连接间共享*/
+type resumeLog struct {
+	sync.Mutex
+	token    string
+	seq      uint64
+	frames   []seqFrame // 最近的消息, 环形缓存
+	next     int
+	current  *Session    // 注册表中的会话对象, 即最近一次的连接
+	attached bool        // current是否在线
+	expire   *time.Timer // 断开后的过期清理
+	expired  bool        // 已过期清理, 不能再恢复
+	window   time.Duration
+}
+
+type seqFrame struct {
+	seq   uint64
+	mtype int
+	data  []byte
+}
+
+// 分配seq并缓存, 在线则同时写入发送队列
+func (l *resumeLog) deliver(mtype int, data []byte) error {
+	l.Lock()
+	defer l.Unlock()
+	l.seq++
+	frame := seqFrame{seq: l.seq, mtype: mtype, data: stampSeq(l.seq, data)}
+	if len(l.frames) < cap(l.frames) {
+		l.frames = append(l.frames, frame)
+	} else {
+		l.frames[l.next] = frame
+		l.next = (l.next + 1) % cap(l.frames)
+	}
+	if !l.attached {
+		return nil // 已缓存, 等待恢复
+	}
+	return l.current.enqueue(frame.mtype, frame.data)
+}
+
+// seq之后的缓存消息, 按seq排序. lost表示部分消息已被覆盖
+func (l *resumeLog) since(seq uint64) (ret []seqFrame, lost bool) {
+	n := len(l.frames)
+	for i := 0; i < n; i++ {
+		f := l.frames[(l.next+i)%n]
+		if f.seq > seq {
+			ret = append(ret, f)
+		}
+	}
+	if seq < l.seq {
+		lost = len(ret) == 0 || ret[0].seq > seq+1
+	}
+	return
+}
+
+// 连接断开, 保留会话等待恢复
+func (l *resumeLog) detach(s *Session) {
+	l.Lock()
+	defer l.Unlock()
+	if l.current != s {
+		return // 已被新连接接管
+	}
+	l.attached = false
+	l.expire = time.AfterFunc(l.window, func() {
+		l.Lock()
+		defer l.Unlock()
+		if l.attached {
+			return
+		}
+		l.expired = true
+		resumes.remove(l.token)
+		sessions.remove(l.current)
+		topics.leaveAll(l.current)
+	})
+}
+
+// 在"{"之后插入seq字段
+func stampSeq(seq uint64, data []byte) []byte {
+	if len(data) < 2 || data[0] != '{' {
+		return data
+	}
+	ret := make([]byte, 0, len(data)+24)
+	ret = append(ret, `{"seq":`...)
+	ret = strconv.AppendUint(ret, seq, 10)
+	if data[1] != '}' {
+		ret = append(ret, ',')
+	}
+	return append(ret, data[1:]...)
+}
+
+/*可恢复会话注册表, 按token索引*/
+type resumeRegistry struct {
+	sync.Mutex
+	byToken map[string]*resumeLog
+}
+
+var resumes = &resumeRegistry{
+	byToken: make(map[string]*resumeLog),
+}
+
+func (r *resumeRegistry) add(l *resumeLog) {
+	r.Lock()
+	r.byToken[l.token] = l
+	r.Unlock()
+}
+
+func (r *resumeRegistry) get(token string) *resumeLog {
+	r.Lock()
+	defer r.Unlock()
+	return r.byToken[token]
+}
+
+func (r *resumeRegistry) remove(token string) {
+	r.Lock()
+	delete(r.byToken, token)
+	r.Unlock()
+}
+
+// 升级后查找待恢复的原会话, 新连接沿用原会话id. 须在启动writeLoop及注册会话之前调用, 接管在OnConnect通过后进行
+func prepareResume(c *gin.Context, s *Session) {
+	token := c.Query(RESUME_TOKEN_PARAM)
+	if token == "" {
+		return
+	}
+	if l := resumes.get(token); l != nil {
+		l.Lock()
+		if !l.expired {
+			s.id, s.resuming = l.current.id, l
+		}
+		l.Unlock()
+	}
+}
+
+// OnConnect通过后注册为可恢复会话: 原会话仍有效则接管并补发消息, 否则创建新会话. 被拒绝的连接不会创建或接管恢复记录
+func attachResume(c *gin.Context, s *Session, conf *Config) {
+	info := &ResumeInfo{}
+	l := s.resuming
+	s.resuming = nil
+	if l != nil {
+		l.Lock()
+		if l.expired {
+			l.Unlock()
+			l = nil
+			sessions.add(s) // 等待OnConnect期间原会话已过期, 沿用其id创建新会话
+		}
+	}
+	if l == nil {
+		bs := make([]byte, 16)
+		rand.Read(bs)
+		l = &resumeLog{
+			token:    hex.EncodeToString(bs),
+			frames:   make([]seqFrame, 0, conf.WbskResumeBuffer),
+			current:  s,
+			attached: true,
+			window:   conf.WbskResumeWindow,
+		}
+		s.resume = l
+		resumes.add(l)
+		info.Id, info.Token = s.id, l.token
+		s.write(websocket.TextMessage, resumeFrame(info))
+		return
+	}
+
+	defer l.Unlock()
+	if l.expire != nil {
+		l.expire.Stop()
+	}
+	prev := l.current
+	if l.attached {
+		prev.shutdown(websocket.CloseGoingAway, CLOSE_RESUMED) // 旧连接尚未断开, 由新连接接管
+	}
+	s.inherit(prev.copyState())
+	s.resume = l
+	limits.inherit(prev, s)
+	sessions.replace(prev, s)
+	topics.replace(prev, s)
+	l.current, l.attached = s, true
+
+	seq, _ := strconv.ParseUint(c.Query(RESUME_SEQ_PARAM), 10, 64)
+	frames, lost := l.since(seq)
+	info.Id, info.Token, info.Seq, info.Resumed, info.Lost = s.id, l.token, l.seq, true, lost
+	s.write(websocket.TextMessage, resumeFrame(info))
+	for _, f := range frames {
+		s.write(f.mtype, f.data)
+	}
+}
+
+func resumeFrame(info *ResumeInfo) []byte {
+	wdata, _ := json.Marshal(&socketReply{
+		Code: api.SUCCESS,
+		Data: info,
+		Tag:  RESUME_TAG,
+	})
+	return wdata
+}
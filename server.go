@@ -29,6 +29,8 @@ type XServer struct {
 	services     []*Service
 	routesFunc   func(server *ginx.Server)
 	registFunc   func(server *grpc.Server)
+	bus          Bus
+	spanExporter SpanExporter
 }
 
 func NewServer() *XServer {
@@ -46,6 +48,8 @@ func (s *XServer) dispose() {
 	s.services = nil
 	s.routesFunc = nil
 	s.registFunc = nil
+	s.bus = nil
+	s.spanExporter = nil
 }
 
 /*用于apigen工具的方法*/
@@ -84,6 +88,16 @@ func (server *XServer) Regist(rf func(server *grpc.Server)) {
 	server.registFunc = rf
 }
 
+/*设置跨实例消息总线, 优先于wbskBus配置*/
+func (server *XServer) Bus(b Bus) {
+	server.bus = b
+}
+
+/*设置追踪导出器, 优先于traceExporter配置*/
+func (server *XServer) SpanExporter(e SpanExporter) {
+	server.spanExporter = e
+}
+
 func (server *XServer) Serve() error {
 	return server.ServeWith(LoadConfig())
 }
@@ -92,6 +106,43 @@ func (server *XServer) ServeWith(config *Config) error {
 
 	config = mergeConfig(config)
 
+	// 校验错误代码注册
+	if err := validateCodes(); err != nil {
+		log.Error(nil, "validate codes error: %v", err)
+		log.Flush()
+		return err
+	}
+	// 校验http状态码映射
+	if err := validateHttpStatus(config); err != nil {
+		log.Error(nil, "validate http status error: %v", err)
+		log.Flush()
+		return err
+	}
+	// 校验websocket子协议
+	if err := validateSocketCodecs(config, server.services); err != nil {
+		log.Error(nil, "validate socket codecs error: %v", err)
+		log.Flush()
+		return err
+	}
+	// 校验websocket可信代理
+	if err := validateTrustedProxies(config); err != nil {
+		log.Error(nil, "validate websocket trusted proxies error: %v", err)
+		log.Flush()
+		return err
+	}
+	// 校验多路复用的方法tag
+	if err := validateMuxTags(config, server.services); err != nil {
+		log.Error(nil, "validate websocket mux error: %v", err)
+		log.Flush()
+		return err
+	}
+	// 加载本地化消息模板
+	if err := loadI18n(config); err != nil {
+		log.Error(nil, "load i18n error: %v", err)
+		log.Flush()
+		return err
+	}
+
 	// 没有配置任何启动,直接退出. 注意: 没有默认80之类的设置
 	if config.GrpcPort == 0 && config.HttpPort == 0 {
 		return nil
@@ -104,8 +155,9 @@ func (server *XServer) ServeWith(config *Config) error {
 		httpListener net.Listener
 		httpCache    cache.Cache
 		err          error
-		grpcfunc     func() // 用于延迟启动
-		httpfunc     func() // 用于延迟启动
+		grpcfunc     func()        // 用于延迟启动
+		httpfunc     func()        // 用于延迟启动
+		drained      chan struct{} // websocket会话关闭完成
 	)
 
 	defer func() {
@@ -121,11 +173,43 @@ func (server *XServer) ServeWith(config *Config) error {
 		if httpListener != nil {
 			httpListener.Close()
 		}
+		// 总线关闭时经httpCache共享的连接池发布唤醒消息, 须先于httpCache关闭
+		if bus != nil {
+			bus.Close()
+		}
 		if httpCache != nil {
 			httpCache.Close()
 		}
+		if tracer != nil {
+			tracer.exporter.Close()
+		}
+		if capturer != nil {
+			capturer.close()
+		}
 	}()
 
+	// 安装追踪导出器
+	exporter := server.spanExporter
+	if exporter == nil {
+		if exporter, err = createSpanExporter(config); err != nil {
+			log.Error(nil, "trace exporter error: %v", err)
+			log.Flush()
+			return err
+		}
+	}
+	setupTracer(exporter, config)
+
+	setupRequestId(config)
+	setupSlowLog(config, server.services)
+	setupCapture(config)
+
+	// 安装访问日志
+	if err = setupAccessLog(config); err != nil {
+		log.Error(nil, "access log error: %v", err)
+		log.Flush()
+		return err
+	}
+
 	// 创建grpc服务器
 	if config.GrpcPort > 0 {
 		// 设置keepalive超时
@@ -134,6 +218,12 @@ func (server *XServer) ServeWith(config *Config) error {
 				Time: config.GrpcKeepAlive,
 			}))
 		}
+		// 安装apix拦截器, 将*api.Response错误转换为grpc状态错误
+		grpcStatus := createGrpcStatusFunc(config)
+		server.serverOption = append(server.serverOption,
+			grpc.ChainUnaryInterceptor(createUnaryServerInterceptor(grpcStatus)),
+			grpc.ChainStreamInterceptor(createStreamServerInterceptor(grpcStatus)),
+		)
 		grpcServer = grpc.NewServer(server.serverOption...)
 		// 安装grpc相关配置
 		for _, smeta := range server.services {
@@ -168,6 +258,7 @@ func (server *XServer) ServeWith(config *Config) error {
 		server.Server.Use(server.middleFilter...)
 		// 安装http相关配置
 		var upgrader *websocket.Upgrader
+		var httpStatus = createHttpStatusFunc(config)
 		var httpRouter ginx.IRouter = server.Server // 设置为顶层
 		for _, smeta := range server.services {
 			if smeta.groupPath != "" {
@@ -176,19 +267,30 @@ func (server *XServer) ServeWith(config *Config) error {
 			for _, mmeta := range smeta.methods {
 				// POST handle
 				if mmeta.handlePath != "" {
-					handlers := append(mmeta.handleFilter, createHandleFunc(mmeta.adapter, mmeta.tag))
+					handlers := append(mmeta.handleFilter, createHandleFunc(mmeta.adapter, mmeta.tag, httpStatus))
 					httpRouter.POST(mmeta.handlePath, handlers...)
 				}
 				// GET socket
 				if mmeta.socketPath != "" {
 					if upgrader == nil {
-						upgrader = createSocketUpgrader(config)
+						upgrader = createSocketUpgrader(config, nil)
 					}
-					handlers := append(mmeta.socketFilter, createSocketFunc(upgrader, mmeta.adapter, mmeta.tag))
+					mupgrader := upgrader
+					if len(mmeta.socketProtocols) > 0 || len(mmeta.socketOrigins) > 0 {
+						mupgrader = createSocketUpgrader(config, mmeta)
+					}
+					handlers := append(mmeta.socketFilter, createSocketFunc(mupgrader, mmeta.adapter, mmeta.tag, config, newSocketHooks(smeta, mmeta)))
 					httpRouter.GET(mmeta.socketPath, handlers...)
 				}
 			}
 		}
+		// 多路复用的websocket入口
+		if config.WbskMuxPath != "" {
+			mux := newSocketMux(server.services)
+			mupgrader := createSocketUpgrader(config, nil)
+			mupgrader.Subprotocols = mux.subprotocols(config)
+			server.Server.GET(config.WbskMuxPath, createSocketMuxFunc(mupgrader, mux, config))
+		}
 		if server.routesFunc != nil {
 			// 附加额外的API设置,预防额外逻辑
 			server.routesFunc(server.Server)
@@ -197,6 +299,27 @@ func (server *XServer) ServeWith(config *Config) error {
 		if config.Name != "" {
 			registerServiceHttp(server.Server, config)
 		}
+		// 注册管理接口
+		if config.AdminPath != "" && config.AdminPort == 0 {
+			registerAdminHttp(server.Server, config)
+		}
+		if config.MetricsPath != "" {
+			server.Server.GET(config.MetricsPath, gin.WrapF(serveMetrics))
+		}
+		// 安装跨实例消息总线
+		xbus := server.bus
+		if xbus == nil {
+			if xbus, err = createBus(config); err != nil {
+				log.Error(nil, "http server bus error: %v", err)
+				log.Flush()
+				return err
+			}
+		}
+		if err = setupBus(xbus); err != nil {
+			log.Error(nil, "http server bus error: %v", err)
+			log.Flush()
+			return err
+		}
 		httpCache = cache.New(config.HttpCache)
 		mux, err := server.Server.Compile(config.HttpEntry, config.HttpPlugin, httpCache)
 		if err != nil {
@@ -207,6 +330,12 @@ func (server *XServer) ServeWith(config *Config) error {
 		httpServer = &http.Server{
 			Handler: mux,
 		}
+		// Shutdown开始时关闭websocket会话, 返回前等待完成
+		drained = make(chan struct{})
+		httpServer.RegisterOnShutdown(func() {
+			drainSessions(config)
+			close(drained)
+		})
 		// 创建监听端口
 		httpListener, err = graceListenHttp(config.HttpHost, config.HttpPort, config.HttpKeepAlive)
 		if err != nil {
@@ -217,7 +346,7 @@ func (server *XServer) ServeWith(config *Config) error {
 		// 支持TLS,或http2.0
 		if config.HttpCertFile != "" {
 			httpfunc = func() {
-				if err := httpServer.ServeTLS(httpListener, config.HttpCertFile, config.HttpKeyFile); err != nil {
+				if err := httpServer.ServeTLS(httpListener, config.HttpCertFile, config.HttpKeyFile); err != nil && err != http.ErrServerClosed {
 					log.Error(nil, "http server serve error: %v", err)
 					log.Flush()
 					os.Exit(1)
@@ -225,7 +354,7 @@ func (server *XServer) ServeWith(config *Config) error {
 			}
 		} else {
 			httpfunc = func() {
-				if err := httpServer.Serve(httpListener); err != nil {
+				if err := httpServer.Serve(httpListener); err != nil && err != http.ErrServerClosed {
 					log.Error(nil, "http server serve error: %v", err)
 					log.Flush()
 					os.Exit(1)
@@ -244,7 +373,16 @@ func (server *XServer) ServeWith(config *Config) error {
 		go httpfunc()
 	}
 	// 优雅关闭http与grpc服务
+	if config.AdminPort > 0 {
+		adminServer := serveAdmin(config)
+		defer adminServer.Close()
+	} else if config.AdminDebug {
+		log.Warn(nil, "admin debug endpoints require adminPort, ignored")
+	}
 	graceShutdownOrRestart(grpcServer, grpcListener, httpServer, httpListener)
+	if drained != nil {
+		<-drained
+	}
 
 	return nil
 }
@@ -11,6 +11,10 @@ type Service struct {
 	groupPath   string
 	groupFilter []gin.HandlerFunc
 	methods     []*Method
+	onConnect   []SocketConnectFunc // 作用于全部方法的websocket钩子, 先于方法的钩子执行
+	onMessage   []SocketMessageFunc
+	onClose     []SocketCloseFunc
+	onTopic     []SocketTopicFunc
 }
 
 func (gs *Service) GroupPath(gpath string) {
@@ -21,6 +25,22 @@ func (gs *Service) GroupFilter(gf gin.HandlerFunc) {
 	gs.groupFilter = append(gs.groupFilter, gf)
 }
 
+func (gs *Service) OnConnect(f SocketConnectFunc) {
+	gs.onConnect = append(gs.onConnect, f)
+}
+
+func (gs *Service) OnMessage(f SocketMessageFunc) {
+	gs.onMessage = append(gs.onMessage, f)
+}
+
+func (gs *Service) OnClose(f SocketCloseFunc) {
+	gs.onClose = append(gs.onClose, f)
+}
+
+func (gs *Service) OnTopic(f SocketTopicFunc) {
+	gs.onTopic = append(gs.onTopic, f)
+}
+
 func (gs *Service) Method(tag string, adapt MethodFunc) *Method {
 	gm := &Method{
 		tag:     tag,
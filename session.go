@@ -0,0 +1,635 @@
+package apix
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/obase/api"
+	"github.com/obase/log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SESSION_KEY  = "_apix_session_" // gin.Context中保存*Session的key
+	USER_KEY_KEY = "_apix_userkey_" // socketFilter可在升级前设置该key绑定用户
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionClosed   = errors.New("session closed")
+	ErrSendQueueFull   = errors.New("send queue full")
+)
+
+/*会话终止原因, 用于日志区分*/
+const (
+	CLOSE_BY_CLIENT      = "closed by client"
+	CLOSE_BY_SERVER      = "closed by server"
+	CLOSE_SHUTDOWN       = "server shutdown"
+	CLOSE_RESUMED        = "resumed by new connection"
+	CLOSE_IDLE_TIMEOUT   = "idle timeout"
+	CLOSE_PONG_TIMEOUT   = "pong timeout"
+	CLOSE_WRITE_TIMEOUT  = "write timeout"
+	CLOSE_WRITE_ERROR    = "write error"
+	CLOSE_MESSAGE_TOOBIG = "message too big"
+	CLOSE_DECODE_ERROR   = "decode error"
+	CLOSE_READ_ERROR     = "read error"
+)
+
+/*websocket会话, 每个升级后的连接对应一个会话*/
+type Session struct {
+	id       string
+	userKey  string
+	conn     *websocket.Conn
+	conf     *Config
+	codec    SocketCodec            // 协商的子协议编解码
+	queue    chan outbound          // 发送队列, 由writeLoop串行写出. websocket.Conn不支持并发写
+	done     chan struct{}          // 会话关闭信号
+	flushed  chan struct{}          // writeLoop退出信号, 关闭前等待队列写出
+	writing  int32                  // writeLoop是否已启动
+	once     sync.Once              // 保证只关闭一次
+	reason   string                 // 终止原因, 由mu保护
+	state    map[string]interface{} // 连接级状态, 由mu保护
+	mu       sync.RWMutex           // 保护reason与state
+	lastRead int64                  // 最近收到消息的时间, 用于空闲检测
+	draining int32                  // 服务关闭中, 停止读取新消息
+	finished chan struct{}          // 处理函数退出信号, 已执行完消息与OnClose钩子
+	resume   *resumeLog             // 可恢复会话的发送记录, 未启用为nil
+	resuming *resumeLog             // 待接管的原会话, OnConnect通过后由attachResume处理
+	bucket   *tokenBucket           // 消息速率限制, 未启用为nil
+	ip       string                 // 客户端IP, 用于连接数限制
+	limitKey string                 // 计入连接数限制的userKey, 由limits的锁保护
+	released bool                   // 已释放连接数, 由limits的锁保护
+	topics   map[string]struct{}    // 已订阅的主题, 由topics注册表的锁保护
+}
+
+type outbound struct {
+	mtype int
+	data  []byte
+}
+
+func newSession(conn *websocket.Conn, conf *Config) *Session {
+	bs := make([]byte, 12)
+	rand.Read(bs)
+	s := &Session{
+		id:       hex.EncodeToString(bs),
+		conn:     conn,
+		conf:     conf,
+		codec:    lookupSocketCodec(conn.Subprotocol()),
+		queue:    make(chan outbound, conf.WbskSendQueueSize),
+		done:     make(chan struct{}),
+		flushed:  make(chan struct{}),
+		finished: make(chan struct{}),
+		lastRead: time.Now().UnixNano(),
+		topics:   make(map[string]struct{}),
+		state:    make(map[string]interface{}),
+	}
+	if conf.WbskCompression && conf.WbskCompressionLevel != 0 {
+		conn.SetCompressionLevel(conf.WbskCompressionLevel)
+	}
+	if conf.WbskMessageRate > 0 {
+		s.bucket = newTokenBucket(conf.WbskMessageRate, conf.WbskMessageBurst)
+	}
+	if conf.WbskMaxMessageSize > 0 {
+		conn.SetReadLimit(conf.WbskMaxMessageSize)
+	}
+	if conf.WbskPingInterval > 0 {
+		conn.SetPongHandler(func(string) error {
+			s.extendReadDeadline()
+			return nil
+		})
+	}
+	s.extendReadDeadline()
+	return s
+}
+
+func (s *Session) Id() string {
+	return s.id
+}
+
+func (s *Session) UserKey() string {
+	sessions.RLock()
+	defer sessions.RUnlock()
+	return s.userKey
+}
+
+/*绑定用户, 之后可用userKey推送消息. 同一用户可绑定多个会话, 超出wbskMaxConnectionsPerUser则以1008关闭会话并返回ErrTooManyConnections*/
+func (s *Session) Bind(userKey string) error {
+	if code, reason := limits.rebind(s, userKey); code != 0 {
+		s.shutdown(code, reason)
+		return ErrTooManyConnections
+	}
+	sessions.bind(s, userKey)
+	return nil
+}
+
+/*读取连接级状态, 如OnConnect中保存的鉴权结果*/
+func (s *Session) Get(key string) (interface{}, bool) {
+	s.mu.RLock()
+	v, ok := s.state[key]
+	s.mu.RUnlock()
+	return v, ok
+}
+
+/*保存连接级状态, 在连接的所有方法调用中可见*/
+func (s *Session) Set(key string, value interface{}) {
+	s.mu.Lock()
+	s.state[key] = value
+	s.mu.Unlock()
+}
+
+// 恢复会话时由新连接继承, 复制避免两个连接共享同一map
+func (s *Session) copyState() map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := make(map[string]interface{}, len(s.state))
+	for k, v := range s.state {
+		ret[k] = v
+	}
+	return ret
+}
+
+// 合并原会话的状态, 已有的key(如OnConnect中设置的)保留
+func (s *Session) inherit(state map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range state {
+		if _, ok := s.state[k]; !ok {
+			s.state[k] = v
+		}
+	}
+}
+
+/*终止原因, 会话关闭前为空*/
+func (s *Session) Reason() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.reason
+}
+
+/*向会话推送api.Response格式的消息, 可在任意goroutine调用*/
+func (s *Session) Push(tag string, data interface{}) error {
+	wdata, err := pushFrame(tag, data)
+	if err != nil {
+		return err
+	}
+	return s.offer(websocket.TextMessage, wdata)
+}
+
+/*订阅主题, 会话关闭时自动退订*/
+func (s *Session) Join(topic string) {
+	topics.join(s, topic)
+}
+
+/*退订主题*/
+func (s *Session) Leave(topic string) {
+	topics.leave(s, topic)
+}
+
+// 阻塞写入发送队列, 用于响应消息
+func (s *Session) write(mtype int, data []byte) error {
+	select {
+	case s.queue <- outbound{mtype: mtype, data: data}:
+		return nil
+	case <-s.done:
+		return ErrSessionClosed
+	}
+}
+
+// 非阻塞写入发送队列, 用于推送与广播. 队列已满则丢弃, 避免慢连接拖累发送方. 可恢复会话先分配seq并缓存
+func (s *Session) offer(mtype int, data []byte) error {
+	if s.resume != nil {
+		return s.resume.deliver(mtype, data)
+	}
+	return s.enqueue(mtype, data)
+}
+
+func (s *Session) enqueue(mtype int, data []byte) error {
+	select {
+	case s.queue <- outbound{mtype: mtype, data: data}:
+		return nil
+	case <-s.done:
+		return ErrSessionClosed
+	default:
+		return ErrSendQueueFull
+	}
+}
+
+// 启动writeLoop, 须在会话对其他goroutine可见前调用
+func (s *Session) start() {
+	atomic.StoreInt32(&s.writing, 1)
+	go s.writeLoop()
+}
+
+// 串行写出发送队列, 同时负责定时ping与空闲检测. 写失败则关闭会话, 会话关闭时先写出队列中剩余的消息
+func (s *Session) writeLoop() {
+	defer close(s.flushed)
+	var tick <-chan time.Time
+	if interval := s.tickInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case m := <-s.queue:
+			if err := s.send(m, s.writeDeadline()); err != nil {
+				if isTimeout(err) {
+					s.abort(websocket.CloseGoingAway, CLOSE_WRITE_TIMEOUT)
+				} else {
+					s.abort(websocket.CloseInternalServerErr, CLOSE_WRITE_ERROR)
+				}
+				return
+			}
+		case now := <-tick:
+			if idle := s.conf.WbskIdleTimeout; idle > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&s.lastRead))) > idle {
+				s.abort(websocket.CloseNormalClosure, CLOSE_IDLE_TIMEOUT)
+				return
+			}
+			if s.conf.WbskPingInterval > 0 {
+				if err := s.conn.WriteControl(websocket.PingMessage, nil, now.Add(s.controlTimeout())); err != nil {
+					s.abort(websocket.CloseGoingAway, CLOSE_WRITE_TIMEOUT)
+					return
+				}
+			}
+		case <-s.done:
+			s.flush()
+			return
+		}
+	}
+}
+
+// 写出队列中剩余的消息, 整体不超过写超时, 超时或写失败则丢弃其余消息
+func (s *Session) flush() {
+	deadline := time.Now().Add(s.controlTimeout())
+	for {
+		select {
+		case m := <-s.queue:
+			if err := s.send(m, deadline); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// 服务关闭时停止读取: 读超时设为当前时间使阻塞的读立即返回, 处理函数随后等待执行中的消息
+func (s *Session) drain() {
+	atomic.StoreInt32(&s.draining, 1)
+	s.conn.SetReadDeadline(time.Now())
+}
+
+func (s *Session) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// 处理函数退出, 由drainSessions等待
+func (s *Session) finish() {
+	close(s.finished)
+}
+
+var errRateLimited = errors.New(CLOSE_RATE_LIMIT)
+
+// 子协议解码失败
+type decodeError struct {
+	error
+}
+
+// 编码并写出一条消息, 编码失败只丢弃该消息
+func (s *Session) send(m outbound, deadline time.Time) error {
+	mtype, data, err := s.codec.Encode(m.mtype, m.data)
+	if err != nil {
+		log.Error(nil, "session %v encoding message: %v", s.id, err)
+		return nil
+	}
+	if s.conf.WbskCompression {
+		s.conn.EnableWriteCompression(len(data) >= s.conf.WbskCompressionThreshold)
+	}
+	s.conn.SetWriteDeadline(deadline)
+	return s.conn.WriteMessage(mtype, data)
+}
+
+// 单条消息的写超时, 未配置返回零值表示不超时
+func (s *Session) writeDeadline() time.Time {
+	if s.conf.WbskWriteTimeout > 0 {
+		return time.Now().Add(s.conf.WbskWriteTimeout)
+	}
+	return time.Time{}
+}
+
+// 读取一条消息并解码为json, 更新空闲时间及读超时
+func (s *Session) read() (int, []byte, error) {
+	mtype, data, err := s.conn.ReadMessage()
+	if err != nil {
+		return mtype, data, err
+	}
+	now := time.Now()
+	atomic.StoreInt64(&s.lastRead, now.UnixNano())
+	s.extendReadDeadline()
+	if s.bucket != nil && !s.bucket.allow(now) {
+		return mtype, nil, errRateLimited
+	}
+	if data, err = s.codec.Decode(data); err != nil {
+		return mtype, nil, decodeError{err}
+	}
+	return mtype, data, nil
+}
+
+// 读失败后关闭会话并返回终止原因
+func (s *Session) readFailed(err error) string {
+	switch {
+	case websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived):
+		s.shutdown(websocket.CloseNormalClosure, CLOSE_BY_CLIENT)
+	case err == websocket.ErrReadLimit:
+		s.shutdown(websocket.CloseMessageTooBig, CLOSE_MESSAGE_TOOBIG) // gorilla已发送关闭帧
+	case err == errRateLimited:
+		atomic.AddUint64(&limits.stats.RateLimited, 1)
+		s.shutdown(websocket.ClosePolicyViolation, CLOSE_RATE_LIMIT)
+	case isDecodeError(err):
+		s.shutdown(websocket.CloseUnsupportedData, CLOSE_DECODE_ERROR)
+	case isTimeout(err):
+		s.shutdown(websocket.CloseGoingAway, CLOSE_PONG_TIMEOUT)
+	default:
+		s.shutdown(websocket.CloseAbnormalClosure, CLOSE_READ_ERROR)
+	}
+	return s.Reason()
+}
+
+// 启用ping时, 超过ping间隔加pong超时仍未收到任何数据则读超时
+func (s *Session) extendReadDeadline() {
+	if s.isDraining() {
+		s.conn.SetReadDeadline(time.Now())
+		return
+	}
+	if s.conf.WbskPingInterval > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(s.conf.WbskPingInterval + s.conf.WbskPongTimeout))
+	}
+}
+
+func (s *Session) tickInterval() time.Duration {
+	if s.conf.WbskPingInterval > 0 {
+		return s.conf.WbskPingInterval
+	}
+	return s.conf.WbskIdleTimeout / 2
+}
+
+func (s *Session) controlTimeout() time.Duration {
+	if s.conf.WbskWriteTimeout > 0 {
+		return s.conf.WbskWriteTimeout
+	}
+	return time.Second
+}
+
+// 发送关闭帧后关闭会话, 只有首个原因生效
+func (s *Session) shutdown(code int, reason string) {
+	s.shutdownWith(code, reason, reason)
+}
+
+// text为关闭帧中的原因, 可与日志中的终止原因不同
+func (s *Session) shutdownWith(code int, reason string, text string) {
+	s.terminate(code, reason, text, true)
+}
+
+// writeLoop自身终止会话, 不等待写出. 会话已在关闭中则直接退出, 由关闭方等待writeLoop
+func (s *Session) abort(code int, reason string) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	s.terminate(code, reason, reason, false)
+}
+
+// 服务关闭中则发送wbskShutdownCode关闭帧
+func (s *Session) close() {
+	if s.isDraining() {
+		s.terminate(s.conf.WbskShutdownCode, CLOSE_SHUTDOWN, s.conf.WbskShutdownReason, true)
+		return
+	}
+	s.terminate(websocket.CloseAbnormalClosure, CLOSE_BY_SERVER, "", true)
+}
+
+// 通知writeLoop写出剩余消息, 等待其退出(最多写超时)后再发送关闭帧并断开连接
+func (s *Session) terminate(code int, reason string, text string, flush bool) {
+	s.once.Do(func() {
+		s.setReason(reason)
+		close(s.done)
+		if flush && atomic.LoadInt32(&s.writing) == 1 {
+			timer := time.NewTimer(s.controlTimeout())
+			select {
+			case <-s.flushed:
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+		if code != websocket.CloseAbnormalClosure && code != websocket.CloseMessageTooBig {
+			s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(s.controlTimeout()))
+		}
+		s.conn.Close()
+	})
+}
+
+func (s *Session) setReason(reason string) {
+	s.mu.Lock()
+	s.reason = reason
+	s.mu.Unlock()
+}
+
+func isDecodeError(err error) bool {
+	_, ok := err.(decodeError)
+	return ok
+}
+
+func isTimeout(err error) bool {
+	if ne, ok := err.(net.Error); ok {
+		return ne.Timeout()
+	}
+	return false
+}
+
+/*获取当前websocket会话, ctx为方法收到的context*/
+func GetSession(ctx context.Context) *Session {
+	if s, ok := ctx.Value(SESSION_KEY).(*Session); ok {
+		return s
+	}
+	return nil
+}
+
+/*按会话id或userKey推送消息, 优先匹配会话id. 配置总线后同时推送到其他实例的会话*/
+func Push(target string, tag string, data interface{}) error {
+	wdata, err := pushFrame(tag, data)
+	if err != nil {
+		return err
+	}
+	targets := sessions.lookup(target)
+	for _, s := range targets {
+		if werr := s.offer(websocket.TextMessage, wdata); werr != nil {
+			err = werr
+		}
+	}
+	if bus != nil {
+		if berr := publishBus(BUS_KIND_PUSH, target, wdata); berr != nil {
+			err = berr
+		}
+	} else if len(targets) == 0 {
+		err = ErrSessionNotFound
+	}
+	return err
+}
+
+func pushFrame(tag string, data interface{}) ([]byte, error) {
+	return json.Marshal(&socketReply{
+		Code: api.SUCCESS,
+		Data: data,
+		Tag:  tag,
+	})
+}
+
+/*会话注册表*/
+type sessionRegistry struct {
+	sync.RWMutex
+	byId   map[string]*Session
+	byUser map[string]map[string]*Session
+}
+
+var sessions = &sessionRegistry{
+	byId:   make(map[string]*Session),
+	byUser: make(map[string]map[string]*Session),
+}
+
+func (r *sessionRegistry) add(s *Session) {
+	r.Lock()
+	r.byId[s.id] = s
+	r.index(s)
+	r.Unlock()
+}
+
+func (r *sessionRegistry) remove(s *Session) {
+	r.Lock()
+	if r.byId[s.id] == s {
+		delete(r.byId, s.id)
+		r.unbind(s)
+	}
+	r.Unlock()
+}
+
+// 恢复会话时由新连接替换原会话, 两者id相同. 新连接未绑定用户时继承原会话的绑定
+func (r *sessionRegistry) replace(prev *Session, s *Session) {
+	r.Lock()
+	defer r.Unlock()
+	if r.byId[prev.id] == prev {
+		r.unbind(prev)
+	}
+	if s.userKey == "" {
+		s.userKey = prev.userKey
+	}
+	r.byId[s.id] = s
+	r.index(s)
+}
+
+// 待恢复的会话尚未注册, 只记录userKey, 接管时再建立索引
+func (r *sessionRegistry) bind(s *Session, userKey string) {
+	r.Lock()
+	defer r.Unlock()
+	if r.byId[s.id] != s {
+		if s.resuming != nil {
+			s.userKey = userKey
+		}
+		return // 已经关闭或尚未接管
+	}
+	r.unbind(s)
+	s.userKey = userKey
+	r.index(s)
+}
+
+// 调用者需持有写锁
+func (r *sessionRegistry) index(s *Session) {
+	if s.userKey == "" {
+		return
+	}
+	users := r.byUser[s.userKey]
+	if users == nil {
+		users = make(map[string]*Session)
+		r.byUser[s.userKey] = users
+	}
+	users[s.id] = s
+}
+
+// 调用者需持有写锁
+func (r *sessionRegistry) unbind(s *Session) {
+	if s.userKey == "" {
+		return
+	}
+	if users := r.byUser[s.userKey]; users != nil {
+		delete(users, s.id)
+		if len(users) == 0 {
+			delete(r.byUser, s.userKey)
+		}
+	}
+}
+
+func (r *sessionRegistry) all() []*Session {
+	r.RLock()
+	defer r.RUnlock()
+	ret := make([]*Session, 0, len(r.byId))
+	for _, s := range r.byId {
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+func (r *sessionRegistry) lookup(target string) []*Session {
+	r.RLock()
+	defer r.RUnlock()
+	if s, ok := r.byId[target]; ok {
+		return []*Session{s}
+	}
+	users := r.byUser[target]
+	ret := make([]*Session, 0, len(users))
+	for _, s := range users {
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+/*
+服务关闭或重启时关闭全部会话. http.Server.Shutdown不跟踪已升级的连接, 需单独处理:
+1. 停止读取新消息, 等待执行中的消息写出响应及OnClose钩子完成, 会话随后发送wbskShutdownCode关闭帧, wbskShutdownReason可携带重连提示
+2. 超过wbskShutdownGrace仍未完成的会话直接关闭
+*/
+func drainSessions(conf *Config) {
+	all := sessions.all()
+	if len(all) == 0 {
+		return
+	}
+	log.Info(nil, "draining %v websocket sessions", len(all))
+	deadline := time.NewTimer(conf.WbskShutdownGrace)
+	defer deadline.Stop()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for _, s := range all {
+		s.drain()
+	}
+	for _, s := range all {
+	wait:
+		for {
+			select {
+			case <-s.finished:
+				break wait
+			case <-ticker.C:
+				s.drain() // 读循环可能在设置后又延长了读超时
+			case <-deadline.C:
+				for _, rest := range all {
+					rest.shutdownWith(conf.WbskShutdownCode, CLOSE_SHUTDOWN, conf.WbskShutdownReason)
+				}
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package apix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/obase/api"
+	"github.com/obase/log"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+慢请求的堆栈快照需要导出全部goroutine, 两次快照至少间隔SLOW_STACK_INTERVAL, 期间超过阈值的请求不带Stack.
+执行请求的goroutine以pprof标签SLOW_STACK_LABEL标记, 快照时按标签查找
+*/
+const (
+	SLOW_STACK_INTERVAL = time.Second
+	SLOW_STACK_LABEL    = "apix.slow"
+)
+
+/*慢请求记录. Stack为超过阈值时执行请求的goroutine的堆栈快照, Payload按captureRedact脱敏, 未配置captureRedact则不记录*/
+type SlowRequest struct {
+	Time      string  `json:"time"`
+	Transport string  `json:"transport"`
+	Method    string  `json:"method"`
+	Code      int     `json:"code"`
+	Latency   float64 `json:"latency"` // 毫秒
+	Threshold float64 `json:"threshold"`
+	ReqSize   int     `json:"reqSize"`
+	Payload   string  `json:"payload,omitempty"` // 截断的请求数据
+	Stack     string  `json:"stack,omitempty"`
+	RequestId string  `json:"requestId,omitempty"`
+	TraceId   string  `json:"traceId,omitempty"`
+}
+
+var slowLog *slowDetector // 为空表示未启用慢请求检测
+
+type slowDetector struct {
+	lastStack   int64 // 上次堆栈快照的时间(纳秒), 与watchId置于首部保证atomic操作在32位平台对齐
+	watchId     uint64
+	threshold   time.Duration            // 全局阈值
+	methods     map[string]time.Duration // 方法阈值, 优先于全局阈值
+	payloadSize int
+	redactor    payloadRedactor // 为空则不记录请求数据
+	mu          sync.Mutex
+	ring        []*SlowRequest // 最近的慢请求
+	next        int
+	full        bool
+}
+
+// 收集全局及方法阈值, 都未配置则不启用
+func setupSlowLog(conf *Config, services []*Service) {
+	methods := make(map[string]time.Duration)
+	for _, smeta := range services {
+		for _, mmeta := range smeta.methods {
+			if mmeta.slowThreshold > 0 {
+				methods[mmeta.tag] = mmeta.slowThreshold
+			}
+		}
+	}
+	if conf.SlowThreshold <= 0 && len(methods) == 0 {
+		slowLog = nil
+		return
+	}
+	slowLog = &slowDetector{
+		threshold:   conf.SlowThreshold,
+		methods:     methods,
+		payloadSize: conf.SlowPayloadSize,
+		redactor:    newPayloadRedactor(conf.CaptureRedact),
+		ring:        make([]*SlowRequest, conf.SlowBufferSize),
+	}
+}
+
+// grpc完整方法名/pkg.Service/Method对应的方法tag Service.Method
+func grpcMethodTag(fullMethod string) string {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	pos := strings.IndexByte(fullMethod, '/')
+	if pos < 0 {
+		return fullMethod
+	}
+	service := fullMethod[:pos]
+	if dot := strings.LastIndexByte(service, '.'); dot >= 0 {
+		service = service[dot+1:]
+	}
+	return service + "." + fullMethod[pos+1:]
+}
+
+func (d *slowDetector) thresholdOf(transport string, tag string) time.Duration {
+	if transport == TRANSPORT_GRPC {
+		tag = grpcMethodTag(tag)
+	}
+	if t, ok := d.methods[tag]; ok {
+		return t
+	}
+	return d.threshold
+}
+
+// 慢请求监视, 超过阈值时在请求仍在执行时保存其goroutine堆栈.
+// 开始与结束须在执行请求的goroutine中调用, 期间该goroutine带有SLOW_STACK_LABEL标签, 结束时恢复为ctx携带的标签
+type slowWatch struct {
+	ctx       context.Context // 请求的context, 结束时恢复其pprof标签
+	threshold time.Duration
+	timer     *time.Timer
+	mu        sync.Mutex
+	stack     []byte
+}
+
+func startSlowWatch(ctx context.Context, transport string, tag string) *slowWatch {
+	d := slowLog
+	if d == nil {
+		return nil
+	}
+	threshold := d.thresholdOf(transport, tag)
+	if threshold <= 0 {
+		return nil
+	}
+	w := &slowWatch{ctx: ctx, threshold: threshold}
+	id := strconv.FormatUint(atomic.AddUint64(&d.watchId, 1), 10)
+	pprof.SetGoroutineLabels(pprof.WithLabels(ctx, pprof.Labels(SLOW_STACK_LABEL, id)))
+	w.timer = time.AfterFunc(threshold, func() {
+		if !d.allowStack() {
+			return
+		}
+		stack := labeledStack(id)
+		w.mu.Lock()
+		w.stack = stack
+		w.mu.Unlock()
+	})
+	return w
+}
+
+// 堆栈快照限流, 距上次快照不足SLOW_STACK_INTERVAL则跳过
+func (d *slowDetector) allowStack() bool {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&d.lastStack)
+	if last != 0 && now-last < int64(SLOW_STACK_INTERVAL) {
+		return false
+	}
+	return atomic.CompareAndSwapInt64(&d.lastStack, last, now)
+}
+
+// 请求结束, 超过阈值则记录慢请求
+func (w *slowWatch) stop(r *requestRecord, code int, latency time.Duration) {
+	if w == nil {
+		return
+	}
+	w.timer.Stop()
+	pprof.SetGoroutineLabels(w.ctx)
+	d := slowLog
+	if d == nil || latency < w.threshold {
+		return
+	}
+	w.mu.Lock()
+	stack := w.stack
+	w.mu.Unlock()
+
+	s := &SlowRequest{
+		Time:      r.start.Format(time.RFC3339Nano),
+		Transport: r.transport,
+		Method:    r.tag,
+		Code:      code,
+		Latency:   float64(latency) / float64(time.Millisecond),
+		Threshold: float64(w.threshold) / float64(time.Millisecond),
+		ReqSize:   r.reqSize,
+		Payload:   d.payload(r.payload),
+		Stack:     string(stack),
+		RequestId: r.requestId,
+	}
+	if r.span != nil {
+		s.TraceId = r.span.TraceId
+	}
+	ctx := r.context()
+	log.Warn(ctx, "%s slow request: transport=%v, latency=%vms, threshold=%vms, size=%v, payload=%v\n%s",
+		logTag(ctx, s.Method), s.Transport, s.Latency, s.Threshold, s.ReqSize, s.Payload, s.Stack)
+	d.add(s)
+}
+
+func (d *slowDetector) add(s *SlowRequest) {
+	if len(d.ring) == 0 {
+		return
+	}
+	d.mu.Lock()
+	d.ring[d.next] = s
+	if d.next++; d.next == len(d.ring) {
+		d.next, d.full = 0, true
+	}
+	d.mu.Unlock()
+}
+
+/*最近的慢请求, 按时间由新到旧*/
+func SlowRequests() []*SlowRequest {
+	d := slowLog
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	size := d.next
+	if d.full {
+		size = len(d.ring)
+	}
+	ret := make([]*SlowRequest, 0, size)
+	for i := 1; i <= size; i++ {
+		ret = append(ret, d.ring[(d.next-i+len(d.ring))%len(d.ring)])
+	}
+	return ret
+}
+
+// 慢请求的管理接口
+func serveSlowRequests(w http.ResponseWriter, r *http.Request) {
+	data, _ := json.Marshal(SlowRequests())
+	w.Header()["Content-Type"] = api.JsonContentType
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// 脱敏后截断的请求数据, 未配置脱敏规则则不记录
+func (d *slowDetector) payload(payload interface{}) string {
+	if len(d.redactor) == 0 {
+		return ""
+	}
+	return truncatePayload(d.redactor.redact(payload, nil), d.payloadSize)
+}
+
+// 请求数据: http与websocket为[]byte, grpc为请求消息, 脱敏后为解析的json或字符串
+func truncatePayload(payload interface{}, size int) string {
+	var bs []byte
+	switch v := payload.(type) {
+	case nil:
+		return ""
+	case []byte:
+		bs = v
+	case string:
+		bs = []byte(v)
+	default:
+		bs, _ = json.Marshal(v)
+	}
+	if size > 0 && len(bs) > size {
+		return string(bs[:size]) + "...(truncated)"
+	}
+	return string(bs)
+}
+
+// 全部goroutine的堆栈, 最多64M
+func allStacks() []byte {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= 64<<20 {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// 带有指定SLOW_STACK_LABEL标签的goroutine堆栈, 从goroutine profile(debug=1)中按标签查找
+func labeledStack(id string) []byte {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return nil
+	}
+	label := []byte(strconv.Quote(SLOW_STACK_LABEL) + ":" + strconv.Quote(id))
+	for _, block := range bytes.Split(buf.Bytes(), []byte("\n\n")) {
+		if bytes.Contains(block, label) {
+			return block
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package apix
+
+import (
+	"bytes"
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowRequest(t *testing.T) {
+	gs := &Service{}
+	gm := gs.Method("Test.Slow", func(ctx context.Context, rdata []byte) (interface{}, error) {
+		time.Sleep(100 * time.Millisecond)
+		return nil, nil
+	})
+	gm.SlowThreshold(20 * time.Millisecond)
+	gs.Method("Test.Fast", func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return nil, nil
+	})
+	setupSlowLog(mergeConfig(&Config{SlowPayloadSize: 30, CaptureRedact: []string{"token"}}), []*Service{gs})
+	defer func() {
+		slowLog = nil
+	}()
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	status := func(code int) int { return http.StatusOK }
+	for _, m := range gs.methods {
+		engine.POST("/"+m.tag, createHandleFunc(m.adapter, m.tag, status))
+	}
+	for _, tag := range []string{"Test.Slow", "Test.Fast", "Test.Slow"} {
+		engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/"+tag, strings.NewReader(`{"token":"secret","name":"slow-request"}`)))
+	}
+
+	list := SlowRequests()
+	if len(list) != 2 {
+		t.Fatalf("unexpected slow requests: %v", len(list))
+	}
+	s := list[1]
+	if s.Method != "Test.Slow" || s.Transport != TRANSPORT_HTTP || s.Latency < 100 || s.Threshold != 20 || !strings.HasPrefix(s.Payload, `{"name":`) || !strings.HasSuffix(s.Payload, "(truncated)") {
+		t.Fatalf("unexpected slow request: %+v", s)
+	}
+	if !strings.Contains(s.Stack, "time.Sleep") {
+		t.Fatalf("stack should be taken while executing: %v", s.Stack)
+	}
+	// 堆栈快照限流, 间隔内的慢请求不带堆栈
+	if list[0].Stack != "" {
+		t.Fatalf("stack snapshot should be rate limited: %v", list[0].Stack)
+	}
+
+	// 未配置脱敏规则时不记录请求数据
+	setupSlowLog(mergeConfig(&Config{SlowThreshold: time.Millisecond}), nil)
+	engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/Test.Slow", strings.NewReader(`{"token":"secret"}`)))
+	if list = SlowRequests(); len(list) != 1 || list[0].Payload != "" {
+		t.Fatalf("payload should be omitted without redaction: %+v", list)
+	}
+}
+
+func TestSlowWatchRestoresLabels(t *testing.T) {
+	setupSlowLog(mergeConfig(&Config{SlowThreshold: time.Hour}), nil)
+	defer func() {
+		slowLog = nil
+	}()
+
+	stopped, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	go pprof.Do(context.Background(), pprof.Labels("apix.test", "caller"), func(ctx context.Context) {
+		startSlowWatch(ctx, TRANSPORT_HTTP, "Test.Labels").stop(&requestRecord{}, 0, 0)
+		close(stopped)
+		<-release
+	})
+	<-stopped
+
+	// 结束后恢复调用方的标签, 不残留SLOW_STACK_LABEL
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	for _, block := range strings.Split(buf.String(), "\n\n") {
+		if strings.Contains(block, `"apix.test":"caller"`) {
+			if strings.Contains(block, SLOW_STACK_LABEL) {
+				t.Fatalf("slow label not removed: %v", block)
+			}
+			return
+		}
+	}
+	t.Fatal("caller labels not restored")
+}
+
+func TestGrpcMethodTag(t *testing.T) {
+	cases := map[string]string{
+		"/api.IPlayer/Add":      "IPlayer.Add",
+		"/IPlayer/Add":          "IPlayer.Add",
+		"/a.b.c.IPlayer/Remove": "IPlayer.Remove",
+	}
+	for full, want := range cases {
+		if got := grpcMethodTag(full); got != want {
+			t.Errorf("grpcMethodTag(%q) = %q, want %q", full, got, want)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package apix
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/obase/api"
+	"github.com/obase/log"
+	"sync"
+)
+
+/*并发模式下的websocket请求帧, id由客户端提供并原样返回*/
+type socketFrame struct {
+	Id     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"` // 多路复用入口的目标方法tag
+	Op     string          `json:"op,omitempty"`     // 控制操作, 如join/leave/broadcast
+	Topic  string          `json:"topic,omitempty"`  // 控制操作的主题
+	Data   json.RawMessage `json:"data,omitempty"`
+
+	Traceparent string `json:"traceparent,omitempty"` // 上游trace, 为空使用升级请求的traceparent头
+	RequestId   string `json:"requestId,omitempty"`   // 请求id, 为空则生成
+}
+
+/*响应信封, 兼容api.Response. http与websocket共用*/
+type socketReply struct {
+	Id        json.RawMessage `json:"id,omitempty"`
+	Code      int             `json:"code"`
+	Msg       string          `json:"msg,omitempty"`
+	Data      interface{}     `json:"data,omitempty"`
+	Tag       string          `json:"tag,omitempty"`
+	Details   []*Detail       `json:"details,omitempty"`
+	Topic     string          `json:"topic,omitempty"` // 广播消息的主题
+	TraceId   string          `json:"traceId,omitempty"`
+	RequestId string          `json:"requestId,omitempty"`
+}
+
+func createSocketFunc(upgrader *websocket.Upgrader, af MethodFunc, tag string, conf *Config, hooks *socketHooks) gin.HandlerFunc {
+	af = hooks.message(af)
+	return func(c *gin.Context) {
+
+		defer recoverHandleFunc(c)
+
+		sc := openSession(c, upgrader, conf, tag)
+		if sc == nil {
+			return
+		}
+		if err := hooks.connect(c, sc); err != nil {
+			log.Warn(c, "%s session %v rejected: %v", tag, sc.id, err)
+			code, reason := rejectCloseCode(err)
+			sc.shutdown(code, reason)
+			closeSession(sc)
+			sc.finish()
+			return
+		}
+		defer func() {
+			closeSession(sc)
+			hooks.close(c, sc)
+			sc.finish()
+		}()
+		if conf.WbskResumeWindow > 0 {
+			attachResume(c, sc, conf)
+		}
+
+		resolve := func(frame *socketFrame) (*gin.Context, MethodFunc, string, *socketHooks, error) {
+			return c, af, tag, hooks, nil
+		}
+		if conf.WbskConcurrency > 0 {
+			serveSocketConcurrent(c, sc, resolve, tag, conf.WbskConcurrency, conf.WbskTopicOps)
+		} else {
+			serveSocketSerial(c, sc, resolve, tag, conf.WbskTopicOps)
+		}
+	}
+}
+
+// 升级连接并注册会话, 方法可通过GetSession(ctx)获取. 升级失败返回nil. 恢复原会话时暂不注册, 由attachResume接管
+func openSession(c *gin.Context, upgrader *websocket.Upgrader, conf *Config, tag string) *Session {
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Error(c, "%s upgrade connection: %v", tag, err)
+		return nil
+	}
+	sc := newSession(conn, conf)
+	sc.ip, sc.limitKey = socketClientIP(conf, c.Request), c.GetString(USER_KEY_KEY)
+	if code, reason := limits.acquire(conf, sc.ip, sc.limitKey); code != 0 {
+		log.Warn(c, "%s session %v from %v rejected: %v", tag, sc.id, sc.ip, reason)
+		sc.shutdown(code, reason)
+		return nil
+	}
+	if conf.WbskResumeWindow > 0 {
+		prepareResume(c, sc)
+	}
+	sc.start()
+	if sc.resuming == nil {
+		sessions.add(sc)
+	}
+	c.Set(SESSION_KEY, sc)
+	if userKey := c.GetString(USER_KEY_KEY); userKey != "" {
+		sc.Bind(userKey)
+	}
+	return sc
+}
+
+func closeSession(sc *Session) {
+	sc.close()
+	limits.release(sc)
+	if sc.resume != nil {
+		sc.resume.detach(sc) // 保留会话等待恢复, 过期后再清理
+		return
+	}
+	sessions.remove(sc)
+	topics.leaveAll(sc)
+}
+
+// 串行模式: 读取一条消息, 执行并回复后再读取下一条. 配置topicOps时, op为允许操作的消息作为主题控制消息处理
+func serveSocketSerial(c *gin.Context, sc *Session, resolve socketResolver, tag string, topicOps []string) {
+	for {
+		mtype, rdata, err := sc.read()
+		if err != nil {
+			logSocketClose(c, sc, tag, err)
+			return
+		}
+		var wdata []byte
+		if frame := parseTopicOp(rdata, topicOps); frame != nil {
+			wdata, _ = json.Marshal(handleTopicOp(c, sc, topicOps, frame, tag, resolve))
+		} else {
+			frame := &socketFrame{Data: rdata}
+			fc, af, ftag, _, _ := resolve(frame)
+			wdata = invokeSocket(fc, af, ftag, frame)
+		}
+		err = sc.write(mtype, wdata)
+		if err != nil {
+			log.Error(c, "%s writing message: %v", tag, err)
+			return
+		}
+	}
+}
+
+// 按终止原因输出日志. 服务关闭中的读超时不关闭会话, 由处理函数等待执行中的消息后关闭
+func logSocketClose(c *gin.Context, sc *Session, tag string, err error) {
+	if sc.isDraining() {
+		log.Info(c, "%s session %v draining", tag, sc.id)
+		return
+	}
+	switch reason := sc.readFailed(err); reason {
+	case CLOSE_BY_CLIENT:
+		log.Info(c, "%s session %v %v: %v", tag, sc.id, reason, err)
+	case CLOSE_READ_ERROR:
+		log.Error(c, "%s session %v reading message: %v", tag, sc.id, err)
+	default:
+		log.Warn(c, "%s session %v closed: %v", tag, sc.id, reason)
+	}
+}
+
+// 解析帧对应的方法, 返回执行方法所用的context及方法的钩子. 主题操作也经过解析, 以执行过滤器与钩子
+type socketResolver func(frame *socketFrame) (*gin.Context, MethodFunc, string, *socketHooks, error)
+
+// 并发模式: 消息格式为{"id":...,"data":...}, 每个连接最多并发执行concurrency条消息, 响应原样返回id以便客户端匹配乱序响应
+func serveSocketConcurrent(c *gin.Context, sc *Session, resolve socketResolver, tag string, concurrency int, topicOps []string) {
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, concurrency)
+	)
+	defer wg.Wait()
+
+	for {
+		mtype, rdata, err := sc.read()
+		if err != nil {
+			logSocketClose(c, sc, tag, err)
+			return
+		}
+		var frame socketFrame
+		if err = json.Unmarshal(rdata, &frame); err != nil {
+			log.Error(c, "%s parsing message: %v", tag, err)
+			wdata, _ := json.Marshal(newSocketReply(c, nil, nil, ParsingRequestError(err, tag), tag))
+			if err = sc.write(mtype, wdata); err != nil {
+				log.Error(c, "%s writing message: %v", tag, err)
+				return
+			}
+			continue
+		}
+		if frame.Op != "" {
+			wdata, _ := json.Marshal(handleTopicOp(c, sc, topicOps, &frame, tag, resolve))
+			if err = sc.write(mtype, wdata); err != nil {
+				log.Error(c, "%s writing message: %v", tag, err)
+				return
+			}
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(mtype int, frame socketFrame) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			defer recoverHandleFunc(c)
+			var wdata []byte
+			if fc, af, ftag, _, err := resolve(&frame); err == nil {
+				wdata = invokeSocket(fc, af, ftag, &frame)
+			} else {
+				log.Error(c, "%s resolving method %v: %v", tag, frame.Method, err)
+				wdata, _ = json.Marshal(newSocketReply(c, frame.Id, nil, err, tag))
+			}
+			if err := sc.write(mtype, wdata); err != nil {
+				log.Error(c, "%s writing message: %v", tag, err)
+				sc.close() // 中断读循环
+			}
+		}(mtype, frame)
+	}
+}
+
+// 执行方法并生成响应. 方法收到的context携带该消息的请求id及span, 连接的其他数据仍来自c
+func invokeSocket(c *gin.Context, af MethodFunc, tag string, frame *socketFrame) []byte {
+	code := api.UNKNOWN
+	parent := frame.Traceparent
+	if parent == "" {
+		parent = c.GetHeader(TRACE_HEADER)
+	}
+	span := startSpan(parent, tag, SPAN_KIND_SERVER)
+	record := beginRequest(c.Request.Context(), TRANSPORT_SOCKET, tag, span)
+	record.requestId = ensureRequestId(frame.RequestId)
+	record.path, record.peer, record.agent = c.Request.URL.Path, c.ClientIP(), c.Request.UserAgent()
+	record.reqSize, record.payload = len(frame.Data), []byte(frame.Data)
+	record.capture = c.GetHeader(CAPTURE_HEADER)
+	defer func() {
+		record.finish(code)
+	}()
+
+	var ctx context.Context = context.WithValue(c, REQUEST_ID_KEY, record.requestId)
+	if span != nil {
+		ctx = context.WithValue(ctx, TRACE_SPAN_KEY, span)
+	}
+	rsp, err := invokeMethod(ctx, TRANSPORT_SOCKET, tag, func() (interface{}, error) {
+		return af(ctx, frame.Data)
+	})
+	if err != nil {
+		log.Error(ctx, "%s execute service: %v", logTag(ctx, tag), err)
+	}
+	reply := newSocketReply(c, frame.Id, rsp, err, tag)
+	reply.stamp(ctx)
+	code = reply.Code
+	wdata, _ := json.Marshal(reply)
+	record.rspSize, record.response = len(wdata), wdata
+	return wdata
+}
+
+func newSocketReply(c *gin.Context, id json.RawMessage, rsp interface{}, err error, tag string) *socketReply {
+	if err == nil {
+		return &socketReply{
+			Id:   id,
+			Code: api.SUCCESS,
+			Data: rsp,
+			Tag:  tag,
+		}
+	}
+	ersp := localizeError(toError(err, tag), c.GetHeader("Accept-Language"))
+	return &socketReply{
+		Id:      id,
+		Code:    ersp.Code,
+		Msg:     ersp.Msg,
+		Tag:     ersp.Tag,
+		Details: ersp.Details,
+	}
+}
+
+// 设置响应中的请求id与trace id
+func (r *socketReply) stamp(ctx context.Context) {
+	if requestIdResponse {
+		r.RequestId = RequestId(ctx)
+	}
+	r.TraceId = TraceId(ctx)
+}
+
+// 创建upgrader, gm为空或未单独指定时使用全局配置
+func createSocketUpgrader(conf *Config, gm *Method) *websocket.Upgrader {
+	var protocols, origins []string
+	if gm != nil {
+		protocols, origins = gm.socketProtocols, gm.socketOrigins
+	}
+	upgrader := new(websocket.Upgrader)
+	if conf.WbskReadBufferSize != 0 {
+		upgrader.ReadBufferSize = conf.WbskReadBufferSize
+	}
+	if conf.WbskWriteBufferSize != 0 {
+		upgrader.WriteBufferSize = conf.WbskWriteBufferSize
+	}
+	upgrader.CheckOrigin = createOriginChecker(conf, origins)
+	upgrader.EnableCompression = conf.WbskCompression
+	if len(protocols) > 0 {
+		upgrader.Subprotocols = protocols
+	} else {
+		upgrader.Subprotocols = conf.WbskSubprotocols
+	}
+	return upgrader
+}
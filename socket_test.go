@@ -0,0 +1,976 @@
+package apix
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 启动只包含一个socket方法的测试服务器
+func newSocketTestServer(t *testing.T, conf *Config, af MethodFunc) (*websocket.Conn, func()) {
+	gin.SetMode(gin.TestMode)
+	conf = mergeConfig(conf)
+	engine := gin.New()
+	engine.GET("/ws", createSocketFunc(createSocketUpgrader(conf, nil), af, "Test.Echo", conf, &socketHooks{}))
+	ts := httptest.NewServer(engine)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+	return conn, func() {
+		conn.Close()
+		ts.Close()
+	}
+}
+
+func TestSocketConcurrent(t *testing.T) {
+	conn, closef := newSocketTestServer(t, &Config{WbskConcurrency: 4}, func(ctx context.Context, rdata []byte) (interface{}, error) {
+		var d time.Duration
+		json.Unmarshal(rdata, &d)
+		time.Sleep(d)
+		return d, nil
+	})
+	defer closef()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":"slow","data":200000000}`))
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":"fast","data":0}`))
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		var reply struct {
+			Id   string `json:"id"`
+			Code int    `json:"code"`
+		}
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, reply.Id)
+	}
+	if ids[0] != "fast" || ids[1] != "slow" {
+		t.Fatalf("unexpected reply order: %v", ids)
+	}
+}
+
+func TestSocketPush(t *testing.T) {
+	conn, closef := newSocketTestServer(t, &Config{}, func(ctx context.Context, rdata []byte) (interface{}, error) {
+		GetSession(ctx).Bind(string(rdata))
+		return "bound", nil
+	})
+	defer closef()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("player-1"))
+	var reply struct {
+		Data string `json:"data"`
+		Tag  string `json:"tag"`
+	}
+	if err := conn.ReadJSON(&reply); err != nil || reply.Data != "bound" {
+		t.Fatalf("bind reply: %v, %v", reply, err)
+	}
+	if err := Push("player-1", "Notify", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.ReadJSON(&reply); err != nil || reply.Data != "hello" || reply.Tag != "Notify" {
+		t.Fatalf("push reply: %v, %v", reply, err)
+	}
+	if err := Push("player-2", "Notify", "hello"); err != ErrSessionNotFound {
+		t.Fatalf("expect ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestSocketTopic(t *testing.T) {
+	conn, closef := newSocketTestServer(t, &Config{WbskConcurrency: 1, WbskTopicOps: []string{TOPIC_OP_JOIN, TOPIC_OP_LEAVE}}, func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return nil, nil
+	})
+	defer closef()
+
+	var reply struct {
+		Id    int    `json:"id"`
+		Code  int    `json:"code"`
+		Data  string `json:"data"`
+		Topic string `json:"topic"`
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":1,"op":"join","topic":"guild-1"}`))
+	if err := conn.ReadJSON(&reply); err != nil || reply.Id != 1 || reply.Code != 0 {
+		t.Fatalf("join reply: %v, %v", reply, err)
+	}
+	if n, err := Broadcast("guild-1", "Chat", "hi"); err != nil || n != 1 {
+		t.Fatalf("broadcast: %v, %v", n, err)
+	}
+	if err := conn.ReadJSON(&reply); err != nil || reply.Topic != "guild-1" || reply.Data != "hi" {
+		t.Fatalf("broadcast reply: %v, %v", reply, err)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":2,"op":"broadcast","topic":"guild-1"}`))
+	if err := conn.ReadJSON(&reply); err != nil || reply.Id != 2 || reply.Code == 0 {
+		t.Fatalf("disallowed op should fail: %v, %v", reply, err)
+	}
+}
+
+func TestSocketTopicSerial(t *testing.T) {
+	conn, closef := newSocketTestServer(t, &Config{WbskTopicOps: []string{TOPIC_OP_JOIN}}, func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return string(rdata), nil
+	})
+	defer closef()
+
+	var reply struct {
+		Id    int    `json:"id"`
+		Code  int    `json:"code"`
+		Data  string `json:"data"`
+		Topic string `json:"topic"`
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":1,"op":"join","topic":"guild-2"}`))
+	if err := conn.ReadJSON(&reply); err != nil || reply.Id != 1 || reply.Code != 0 || reply.Topic != "guild-2" {
+		t.Fatalf("join reply: %v, %v", reply, err)
+	}
+	if n, err := Broadcast("guild-2", "Chat", "hi"); err != nil || n != 1 {
+		t.Fatalf("broadcast: %v, %v", n, err)
+	}
+	if err := conn.ReadJSON(&reply); err != nil || reply.Topic != "guild-2" || reply.Data != "hi" {
+		t.Fatalf("broadcast reply: %v, %v", reply, err)
+	}
+	// op不在允许列表中的消息仍交给方法
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"op":"leave","topic":"guild-2"}`))
+	if err := conn.ReadJSON(&reply); err != nil || reply.Data != `{"op":"leave","topic":"guild-2"}` {
+		t.Fatalf("method reply: %v, %v", reply, err)
+	}
+}
+
+func TestSocketTopicRejected(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	conf := mergeConfig(&Config{WbskTopicOps: []string{TOPIC_OP_JOIN}})
+	gs := &Service{}
+	gm := gs.Method("Test.Guild", func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return nil, nil
+	})
+	gm.OnTopic(func(ctx context.Context, s *Session, op string, topic string) error {
+		if topic != "guild-40" {
+			return NewError(METHOD_NOT_ALLOWED, "not a member of %v", topic)
+		}
+		return nil
+	})
+	engine := gin.New()
+	engine.GET("/ws", createSocketFunc(createSocketUpgrader(conf, nil), gm.adapter, gm.tag, conf, newSocketHooks(gs, gm)))
+	ts := httptest.NewServer(engine)
+	defer ts.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var reply struct {
+		Id   int `json:"id"`
+		Code int `json:"code"`
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":1,"op":"join","topic":"guild-42"}`))
+	if err := conn.ReadJSON(&reply); err != nil || reply.Id != 1 || reply.Code != METHOD_NOT_ALLOWED {
+		t.Fatalf("rejected join reply: %v, %v", reply, err)
+	}
+	if n, _ := Broadcast("guild-42", "Chat", "hi"); n != 0 {
+		t.Fatalf("rejected join still subscribed: %v", n)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":2,"op":"join","topic":"guild-40"}`))
+	if err := conn.ReadJSON(&reply); err != nil || reply.Id != 2 || reply.Code != 0 {
+		t.Fatalf("allowed join reply: %v, %v", reply, err)
+	}
+}
+
+func TestSocketMuxTopicRejected(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	conf := mergeConfig(&Config{WbskMuxPath: "/ws", WbskConcurrency: 2, WbskTopicOps: []string{TOPIC_OP_JOIN}})
+	service := &Service{}
+	service.Method("IGuild.Chat", func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return nil, nil
+	}).SocketFilter(func(c *gin.Context) {
+		c.AbortWithStatus(403)
+	})
+	engine := gin.New()
+	engine.GET("/ws", createSocketMuxFunc(createSocketUpgrader(conf, nil), newSocketMux([]*Service{service}), conf))
+	ts := httptest.NewServer(engine)
+	defer ts.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 未指定方法或方法过滤器拒绝时不能加入主题
+	expects := map[string]int{"none": METHOD_NOT_FOUND, "filtered": METHOD_NOT_ALLOWED}
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":"none","op":"join","topic":"guild-43"}`))
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":"filtered","method":"IGuild.Chat","op":"join","topic":"guild-43"}`))
+	for range expects {
+		var reply struct {
+			Id   string `json:"id"`
+			Code int    `json:"code"`
+		}
+		if err := conn.ReadJSON(&reply); err != nil || reply.Code != expects[reply.Id] {
+			t.Fatalf("unexpected reply: %v, %v", reply, err)
+		}
+	}
+	if n, _ := Broadcast("guild-43", "Chat", "hi"); n != 0 {
+		t.Fatalf("rejected join still subscribed: %v", n)
+	}
+}
+
+func TestSocketTimeouts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	// 启动带OnClose钩子的测试服务器, 返回地址及终止原因
+	serve := func(conf *Config, af MethodFunc) (string, <-chan string, func()) {
+		conf = mergeConfig(conf)
+		gs := &Service{}
+		gm := gs.Method("Test.Timeout", af)
+		closed := make(chan string, 1)
+		gm.OnClose(func(ctx context.Context, s *Session, reason string) {
+			closed <- reason
+		})
+		engine := gin.New()
+		engine.GET("/ws", createSocketFunc(createSocketUpgrader(conf, nil), gm.adapter, gm.tag, conf, newSocketHooks(gs, gm)))
+		ts := httptest.NewServer(engine)
+		return "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws", closed, ts.Close
+	}
+	expectReason := func(t *testing.T, closed <-chan string, expect string) {
+		select {
+		case reason := <-closed:
+			if reason != expect {
+				t.Fatalf("expect reason %q, got %q", expect, reason)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("OnClose not called")
+		}
+	}
+	expectClose := func(t *testing.T, conn *websocket.Conn, code int, text string) {
+		for {
+			_, _, err := conn.ReadMessage()
+			if err == nil {
+				continue
+			}
+			if ce, ok := err.(*websocket.CloseError); !ok || ce.Code != code || ce.Text != text {
+				t.Fatalf("expect close %v %q, got %v", code, text, err)
+			}
+			return
+		}
+	}
+	echo := func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return nil, nil
+	}
+
+	t.Run("pong", func(t *testing.T) {
+		url, closed, closef := serve(&Config{WbskPingInterval: 50 * time.Millisecond, WbskPongTimeout: 50 * time.Millisecond}, echo)
+		defer closef()
+
+		// 回复pong的连接在超时之后仍保持
+		alive, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alive.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		if _, _, err = alive.ReadMessage(); !isTimeout(err) {
+			t.Fatalf("connection answering pings should stay open: %v", err)
+		}
+		alive.Close()
+		expectReason(t, closed, CLOSE_READ_ERROR)
+
+		// 不回复pong则以1001关闭
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetPingHandler(func(string) error { return nil })
+		expectClose(t, conn, websocket.CloseGoingAway, CLOSE_PONG_TIMEOUT)
+		expectReason(t, closed, CLOSE_PONG_TIMEOUT)
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		url, closed, closef := serve(&Config{WbskIdleTimeout: 100 * time.Millisecond}, echo)
+		defer closef()
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		start := time.Now()
+		expectClose(t, conn, websocket.CloseNormalClosure, CLOSE_IDLE_TIMEOUT)
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Fatalf("closed before idle timeout: %v", elapsed)
+		}
+		expectReason(t, closed, CLOSE_IDLE_TIMEOUT)
+	})
+
+	t.Run("write", func(t *testing.T) {
+		// 客户端不读取, 推送填满socket缓冲区后写超时. 此时关闭帧也无法写出, 客户端只能读到连接断开
+		payload := strings.Repeat("x", 1<<20)
+		url, closed, closef := serve(&Config{WbskWriteTimeout: 50 * time.Millisecond}, func(ctx context.Context, rdata []byte) (interface{}, error) {
+			s := GetSession(ctx)
+			for i := 0; i < 32; i++ {
+				s.Push("Fill", payload)
+			}
+			return nil, nil
+		})
+		defer closef()
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte("{}"))
+		expectReason(t, closed, CLOSE_WRITE_TIMEOUT)
+		for {
+			if _, _, err = conn.ReadMessage(); err != nil {
+				break
+			}
+		}
+	})
+}
+
+func TestSocketFlushOnClose(t *testing.T) {
+	conn, closef := newSocketTestServer(t, &Config{}, func(ctx context.Context, rdata []byte) (interface{}, error) {
+		s := GetSession(ctx)
+		for i := 0; i < 3; i++ {
+			s.Push("Notify", i)
+		}
+		s.close()
+		return nil, nil
+	})
+	defer closef()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("{}"))
+	for i := 0; i < 3; i++ {
+		var reply struct {
+			Data int `json:"data"`
+		}
+		if err := conn.ReadJSON(&reply); err != nil || reply.Data != i {
+			t.Fatalf("queued push %v: %v, %v", i, reply, err)
+		}
+	}
+}
+
+func TestSocketMux(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	conf := mergeConfig(&Config{WbskMuxPath: "/ws", WbskConcurrency: 2})
+	service := &Service{}
+	service.Method("IPlayer.Get", func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return ctx.Value("user"), nil
+	}).SocketFilter(func(c *gin.Context) {
+		c.Set("user", "u1")
+	})
+	service.Method("IPlayer.Del", func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return "deleted", nil
+	}).SocketFilter(func(c *gin.Context) {
+		c.AbortWithStatus(403)
+	})
+	// 过滤器看到的是入口路径, 访问日志等记录同样使用该路径
+	service.Method("IPlayer.Path", func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return ctx.Value("user"), nil
+	}).SocketFilter(func(c *gin.Context) {
+		c.Set("user", c.Request.URL.Path)
+	})
+
+	engine := gin.New()
+	engine.GET("/ws", createSocketMuxFunc(createSocketUpgrader(conf, nil), newSocketMux([]*Service{service}), conf))
+	ts := httptest.NewServer(engine)
+	defer ts.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expects := map[string]int{"IPlayer.Get": 0, "IPlayer.Del": METHOD_NOT_ALLOWED, "IPlayer.Add": METHOD_NOT_FOUND, "IPlayer.Path": 0}
+	datas := map[string]string{"IPlayer.Get": "u1", "IPlayer.Path": "/ws"}
+	for method := range expects {
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"method":"`+method+`","id":"`+method+`"}`))
+	}
+	for range expects {
+		var reply struct {
+			Id   string `json:"id"`
+			Code int    `json:"code"`
+			Data string `json:"data"`
+		}
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Code != expects[reply.Id] || reply.Data != datas[reply.Id] {
+			t.Fatalf("unexpected reply: %v", reply)
+		}
+	}
+}
+
+func TestSocketMuxDuplicateTag(t *testing.T) {
+	conf := &Config{WbskMuxPath: "/ws"}
+	s1, s2 := &Service{}, &Service{}
+	s1.Method("IPlayer.Get", nil)
+	s2.Method("IPlayer.Get", nil)
+	s2.Method("IPlayer.Add", nil)
+	if err := validateMuxTags(conf, []*Service{s1, s2}); err == nil || !strings.Contains(err.Error(), "IPlayer.Get") {
+		t.Fatalf("expect duplicate tag error, got %v", err)
+	}
+	if err := validateMuxTags(&Config{}, []*Service{s1, s2}); err != nil {
+		t.Fatalf("mux disabled: %v", err)
+	}
+}
+
+func TestSocketMuxOrigins(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	conf := mergeConfig(&Config{WbskMuxPath: "/ws", WbskNotCheckOrigin: true})
+	service := &Service{}
+	service.Method("IPlayer.Get", func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return "ok", nil
+	})
+	service.Method("IAdmin.Kick", func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return "kicked", nil
+	}).SocketOrigins("https://portal.example.com")
+
+	engine := gin.New()
+	engine.GET("/ws", createSocketMuxFunc(createSocketUpgrader(conf, nil), newSocketMux([]*Service{service}), conf))
+	ts := httptest.NewServer(engine)
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+
+	for origin, expects := range map[string]map[string]int{
+		"https://evil.com":           {"IPlayer.Get": 0, "IAdmin.Kick": METHOD_NOT_ALLOWED},
+		"https://portal.example.com": {"IPlayer.Get": 0, "IAdmin.Kick": 0},
+	} {
+		conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {origin}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for method := range expects {
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"method":"`+method+`","id":"`+method+`"}`))
+		}
+		for range expects {
+			var reply struct {
+				Id   string `json:"id"`
+				Code int    `json:"code"`
+			}
+			if err := conn.ReadJSON(&reply); err != nil || reply.Code != expects[reply.Id] {
+				t.Fatalf("origin %v: unexpected reply: %v, %v", origin, reply, err)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestSocketMaxMessageSize(t *testing.T) {
+	conn, closef := newSocketTestServer(t, &Config{WbskMaxMessageSize: 16}, func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return string(rdata), nil
+	})
+	defer closef()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 64)))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("expected close 1009, got %v", err)
+	}
+}
+
+func TestSocketStructpb(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	conf := mergeConfig(&Config{WbskCompression: true, WbskSubprotocols: []string{SUBPROTOCOL_JSON, SUBPROTOCOL_STRUCTPB}})
+	engine := gin.New()
+	engine.GET("/ws", createSocketFunc(createSocketUpgrader(conf, nil), func(ctx context.Context, rdata []byte) (interface{}, error) {
+		var name string
+		err := json.Unmarshal(rdata, &name)
+		return "hello " + name, err
+	}, "Test.Hello", conf, &socketHooks{}))
+	ts := httptest.NewServer(engine)
+	defer ts.Close()
+
+	dialer := &websocket.Dialer{Subprotocols: []string{SUBPROTOCOL_STRUCTPB}, EnableCompression: true}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != SUBPROTOCOL_STRUCTPB {
+		t.Fatalf("negotiated subprotocol: %q", conn.Subprotocol())
+	}
+
+	wdata, _ := proto.Marshal(structpb.NewStringValue("apix"))
+	conn.WriteMessage(websocket.BinaryMessage, wdata)
+	mtype, rdata, err := conn.ReadMessage()
+	if err != nil || mtype != websocket.BinaryMessage {
+		t.Fatalf("read reply: %v, %v", mtype, err)
+	}
+	var reply structpb.Value
+	if err = proto.Unmarshal(rdata, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if data := reply.GetStructValue().GetFields()["data"].GetStringValue(); data != "hello apix" {
+		t.Fatalf("unexpected reply: %v", reply.String())
+	}
+}
+
+func TestStructpbUnsafeInteger(t *testing.T) {
+	codec := structpbCodec{}
+	for _, jdata := range []string{`{"id":9007199254740993}`, `[-9007199254740993]`, `{"id":123456789012345678901234}`} {
+		if _, _, err := codec.Encode(websocket.TextMessage, []byte(jdata)); err != errUnsafeInteger {
+			t.Fatalf("encode %v: expect unsafe integer, got %v", jdata, err)
+		}
+	}
+	if _, _, err := codec.Encode(websocket.TextMessage, []byte(`{"id":9007199254740992,"ratio":1.5e300,"name":"12345678901234567890"}`)); err != nil {
+		t.Fatalf("encode safe values: %v", err)
+	}
+	wdata, _ := proto.Marshal(structpb.NewNumberValue(1 << 60))
+	if _, err := codec.Decode(wdata); err != errUnsafeInteger {
+		t.Fatalf("decode: expect unsafe integer, got %v", err)
+	}
+}
+
+func TestSocketMuxProtocols(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	conf := mergeConfig(&Config{WbskMuxPath: "/ws", WbskSubprotocols: []string{SUBPROTOCOL_JSON}})
+	service := &Service{}
+	service.Method("IPlayer.Get", func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return "ok", nil
+	})
+	service.Method("IPlayer.Bin", func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return "ok", nil
+	}).SocketProtocols(SUBPROTOCOL_STRUCTPB)
+
+	mux := newSocketMux([]*Service{service})
+	upgrader := createSocketUpgrader(conf, nil)
+	upgrader.Subprotocols = mux.subprotocols(conf)
+	engine := gin.New()
+	engine.GET("/ws", createSocketMuxFunc(upgrader, mux, conf))
+	ts := httptest.NewServer(engine)
+	defer ts.Close()
+
+	dialer := &websocket.Dialer{Subprotocols: []string{SUBPROTOCOL_JSON}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expects := map[string]int{"IPlayer.Get": 0, "IPlayer.Bin": METHOD_NOT_ALLOWED}
+	for method := range expects {
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"method":"`+method+`","id":"`+method+`"}`))
+	}
+	for range expects {
+		var reply struct {
+			Id   string `json:"id"`
+			Code int    `json:"code"`
+		}
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Code != expects[reply.Id] {
+			t.Fatalf("unexpected reply: %v", reply)
+		}
+	}
+
+	dialer.Subprotocols = []string{SUBPROTOCOL_STRUCTPB}
+	bconn, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bconn.Close()
+	if bconn.Subprotocol() != SUBPROTOCOL_STRUCTPB {
+		t.Fatalf("method subprotocol not offered by mux: %q", bconn.Subprotocol())
+	}
+}
+
+func TestSocketHooks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	conf := mergeConfig(&Config{})
+	gs := &Service{}
+	gs.OnConnect(func(ctx context.Context, s *Session) error {
+		if token := ctx.(*gin.Context).Query("token"); token != "" {
+			s.Set("user", token)
+			return nil
+		}
+		return RejectConnection(4001, "unauthorized")
+	})
+	closed := make(chan string, 1)
+	gm := gs.Method("Test.Whoami", func(ctx context.Context, rdata []byte) (interface{}, error) {
+		user, _ := GetSession(ctx).Get("user")
+		return user, nil
+	})
+	gm.OnClose(func(ctx context.Context, s *Session, reason string) {
+		closed <- reason
+	})
+	engine := gin.New()
+	engine.GET("/ws", createSocketFunc(createSocketUpgrader(conf, nil), gm.adapter, gm.tag, conf, newSocketHooks(gs, gm)))
+	ts := httptest.NewServer(engine)
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = conn.ReadMessage(); !websocket.IsCloseError(err, 4001) {
+		t.Fatalf("expected close 4001, got %v", err)
+	}
+	conn.Close()
+
+	conn, _, err = websocket.DefaultDialer.Dial(url+"?token=player-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("{}"))
+	var reply struct {
+		Data string `json:"data"`
+	}
+	if err = conn.ReadJSON(&reply); err != nil || reply.Data != "player-1" {
+		t.Fatalf("state reply: %v, %v", reply, err)
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	select {
+	case reason := <-closed:
+		if reason != CLOSE_BY_CLIENT {
+			t.Fatalf("close reason: %v", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnClose not called")
+	}
+	conn.Close()
+}
+
+func TestSocketDrain(t *testing.T) {
+	conf := &Config{WbskShutdownGrace: time.Second, WbskShutdownReason: "reconnect"}
+	conn, closef := newSocketTestServer(t, conf, func(ctx context.Context, rdata []byte) (interface{}, error) {
+		time.Sleep(200 * time.Millisecond)
+		return "done", nil
+	})
+	defer closef()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("{}"))
+	time.Sleep(50 * time.Millisecond)
+	go drainSessions(conf)
+
+	var reply struct {
+		Data string `json:"data"`
+	}
+	if err := conn.ReadJSON(&reply); err != nil || reply.Data != "done" {
+		t.Fatalf("in-flight reply: %v, %v", reply, err)
+	}
+	_, _, err := conn.ReadMessage()
+	if ce, ok := err.(*websocket.CloseError); !ok || ce.Code != websocket.CloseGoingAway || ce.Text != "reconnect" {
+		t.Fatalf("expected going away, got %v", err)
+	}
+}
+
+func TestSocketDrainConcurrent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	conf := mergeConfig(&Config{WbskConcurrency: 2, WbskShutdownGrace: 2 * time.Second})
+	var calls int32
+	gs := &Service{}
+	gm := gs.Method("Test.Slow", func(ctx context.Context, rdata []byte) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(200 * time.Millisecond)
+		return "done", nil
+	})
+	var hooked int32
+	gm.OnClose(func(ctx context.Context, s *Session, reason string) {
+		time.Sleep(100 * time.Millisecond)
+		atomic.StoreInt32(&hooked, 1)
+	})
+	engine := gin.New()
+	engine.GET("/ws", createSocketFunc(createSocketUpgrader(conf, nil), gm.adapter, gm.tag, conf, newSocketHooks(gs, gm)))
+	ts := httptest.NewServer(engine)
+	defer ts.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":1}`))
+	time.Sleep(50 * time.Millisecond)
+	drained := make(chan struct{})
+	go func() {
+		drainSessions(conf)
+		close(drained)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":2}`)) // 已停止读取, 不再执行
+
+	var reply struct {
+		Id   int    `json:"id"`
+		Data string `json:"data"`
+	}
+	if err := conn.ReadJSON(&reply); err != nil || reply.Id != 1 || reply.Data != "done" {
+		t.Fatalf("in-flight reply: %v, %v", reply, err)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected going away, got %v", err)
+	}
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("drain did not return")
+	}
+	if atomic.LoadInt32(&hooked) != 1 {
+		t.Fatal("drain returned before OnClose finished")
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("expect 1 call after drain, got %v", n)
+	}
+}
+
+func TestSocketResume(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	conf := mergeConfig(&Config{WbskResumeWindow: time.Second})
+	engine := gin.New()
+	engine.GET("/ws", createSocketFunc(createSocketUpgrader(conf, nil), func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return nil, nil
+	}, "Test.Resume", conf, &socketHooks{}))
+	ts := httptest.NewServer(engine)
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+
+	type frame struct {
+		Seq  uint64          `json:"seq"`
+		Tag  string          `json:"tag"`
+		Data json.RawMessage `json:"data"`
+	}
+	var hello frame
+	var info ResumeInfo
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.ReadJSON(&hello); err != nil || hello.Tag != RESUME_TAG {
+		t.Fatalf("hello: %v, %v", hello, err)
+	}
+	json.Unmarshal(hello.Data, &info)
+
+	Push(info.Id, "Notify", "a")
+	var f frame
+	if err = conn.ReadJSON(&f); err != nil || f.Seq != 1 {
+		t.Fatalf("push: %v, %v", f, err)
+	}
+	conn.Close()
+	time.Sleep(100 * time.Millisecond) // 等待服务端检测断开
+
+	Push(info.Id, "Notify", "b")
+	Push(info.Id, "Notify", "c")
+
+	conn, _, err = websocket.DefaultDialer.Dial(url+"?resume_token="+info.Token+"&resume_seq=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var resumed ResumeInfo
+	if err = conn.ReadJSON(&hello); err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal(hello.Data, &resumed)
+	if !resumed.Resumed || resumed.Id != info.Id || resumed.Seq != 3 || resumed.Lost {
+		t.Fatalf("resume info: %+v", resumed)
+	}
+	for _, want := range []string{`"b"`, `"c"`} {
+		if err = conn.ReadJSON(&f); err != nil || string(f.Data) != want {
+			t.Fatalf("replay: %v, %v", f, err)
+		}
+	}
+}
+
+func TestSocketUserLimitOnBind(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	conf := mergeConfig(&Config{WbskMaxConnectionsPerUser: 1})
+	binds := make(chan error, 2)
+	gs := &Service{}
+	gs.OnConnect(func(ctx context.Context, s *Session) error {
+		binds <- s.Bind(ctx.(*gin.Context).Query("user"))
+		return nil
+	})
+	gm := gs.Method("Test.Limit", func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return nil, GetSession(ctx).Bind(string(rdata))
+	})
+	engine := gin.New()
+	engine.GET("/ws", createSocketFunc(createSocketUpgrader(conf, nil), gm.adapter, gm.tag, conf, newSocketHooks(gs, gm)))
+	ts := httptest.NewServer(engine)
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?user=u1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = <-binds; err != nil {
+		t.Fatal(err)
+	}
+
+	// OnConnect中绑定同一用户超出限制
+	second, _, err := websocket.DefaultDialer.Dial(url+"?user=u1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-binds; err != ErrTooManyConnections {
+		t.Fatalf("expect ErrTooManyConnections, got %v", err)
+	}
+	if _, _, err = second.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected per-user rejection, got %v", err)
+	}
+	second.Close()
+
+	// 之后在方法中改绑到已满的用户同样被拒绝
+	third, _, err := websocket.DefaultDialer.Dial(url+"?user=u2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	<-binds
+	third.WriteMessage(websocket.TextMessage, []byte("u1"))
+	for {
+		if _, _, err = third.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected per-user rejection on bind, got %v", err)
+	}
+}
+
+func TestSocketResumeRejected(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	conf := mergeConfig(&Config{WbskResumeWindow: time.Second})
+	gs := &Service{}
+	gs.OnConnect(func(ctx context.Context, s *Session) error {
+		if ctx.(*gin.Context).Query("deny") != "" {
+			return RejectConnection(4003, "forbidden")
+		}
+		return nil
+	})
+	gm := gs.Method("Test.Resume", func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return GetSession(ctx).Id(), nil
+	})
+	engine := gin.New()
+	engine.GET("/ws", createSocketFunc(createSocketUpgrader(conf, nil), gm.adapter, gm.tag, conf, newSocketHooks(gs, gm)))
+	ts := httptest.NewServer(engine)
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+
+	var hello struct {
+		Tag  string     `json:"tag"`
+		Data ResumeInfo `json:"data"`
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = conn.ReadJSON(&hello); err != nil || hello.Tag != RESUME_TAG {
+		t.Fatalf("hello: %v, %v", hello, err)
+	}
+	info := hello.Data
+
+	// 被拒绝的连接不能接管原会话
+	denied, _, err := websocket.DefaultDialer.Dial(url+"?deny=1&resume_token="+info.Token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = denied.ReadMessage(); !websocket.IsCloseError(err, 4003) {
+		t.Fatalf("expected close 4003, got %v", err)
+	}
+	denied.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("{}"))
+	var reply struct {
+		Data string `json:"data"`
+	}
+	if err = conn.ReadJSON(&reply); err != nil || reply.Data != info.Id {
+		t.Fatalf("original session should survive: %v, %v", reply, err)
+	}
+	if n := len(sessions.lookup(info.Id)); n != 1 {
+		t.Fatalf("expect original session registered, got %v", n)
+	}
+
+	// 通过OnConnect后接管
+	resumed, _, err := websocket.DefaultDialer.Dial(url+"?resume_token="+info.Token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	if err = resumed.ReadJSON(&hello); err != nil || !hello.Data.Resumed || hello.Data.Id != info.Id {
+		t.Fatalf("resume: %+v, %v", hello, err)
+	}
+	if _, _, err = conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected original closed by resume, got %v", err)
+	}
+}
+
+func TestSocketClientIP(t *testing.T) {
+	conf := &Config{WbskTrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"}}
+	cases := []struct {
+		remote string
+		xff    string
+		expect string
+	}{
+		{"203.0.113.1:1234", "198.51.100.7", "203.0.113.1"},                     // 非可信代理忽略X-Forwarded-For
+		{"10.1.2.3:1234", "", "10.1.2.3"},                                       // 可信代理未转发地址
+		{"10.1.2.3:1234", "198.51.100.7", "198.51.100.7"},                       // 可信代理转发的地址
+		{"10.1.2.3:1234", "1.1.1.1, 198.51.100.7, 192.168.1.1", "198.51.100.7"}, // 客户端伪造的左侧地址被忽略
+		{"10.1.2.3:1234", "garbage", "10.1.2.3"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		r.RemoteAddr = c.remote
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if ip := socketClientIP(conf, r); ip != c.expect {
+			t.Fatalf("%v %q: expect %v, got %v", c.remote, c.xff, c.expect, ip)
+		}
+	}
+	if err := validateTrustedProxies(&Config{WbskTrustedProxies: []string{"10.0.0.0/33"}}); err == nil {
+		t.Fatal("invalid trusted proxy should be rejected")
+	}
+}
+
+func TestSocketLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	conf := mergeConfig(&Config{WbskMaxConnectionsPerIP: 1, WbskMessageRate: 1, WbskMessageBurst: 2})
+	engine := gin.New()
+	engine.GET("/ws", createSocketFunc(createSocketUpgrader(conf, nil), func(ctx context.Context, rdata []byte) (interface{}, error) {
+		return nil, nil
+	}, "Test.Limit", conf, &socketHooks{}))
+	ts := httptest.NewServer(engine)
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 同一IP的第二个连接被拒绝, 伪造X-Forwarded-For不能绕过
+	second, _, err := websocket.DefaultDialer.Dial(url, http.Header{"X-Forwarded-For": {"203.0.113.9"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = second.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected per-ip rejection, got %v", err)
+	}
+	second.Close()
+
+	// 超出令牌桶容量后关闭
+	for i := 0; i < 3; i++ {
+		conn.WriteMessage(websocket.TextMessage, []byte("{}"))
+	}
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected rate limit close, got %v", err)
+	}
+	if stats := GetSocketStats(); stats.RejectIP == 0 || stats.RateLimited == 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
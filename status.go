@@ -0,0 +1,62 @@
+package apix
+
+import (
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"net/http"
+	"sort"
+)
+
+// 校验http状态码配置, 非法状态码会导致WriteHeader panic
+func validateHttpStatus(conf *Config) error {
+	var invalid []int
+	for code, status := range conf.HttpStatusMapping {
+		if !validHttpStatus(status) {
+			invalid = append(invalid, code)
+		}
+	}
+	if len(invalid) > 0 {
+		sort.Ints(invalid)
+		return fmt.Errorf("invalid http status in httpStatusMapping for codes: %v", invalid)
+	}
+	if !validHttpStatus(conf.HttpStatusDefault) {
+		return fmt.Errorf("invalid httpStatusDefault: %v", conf.HttpStatusDefault)
+	}
+	return nil
+}
+
+func validHttpStatus(status int) bool {
+	return status >= 100 && status <= 999
+}
+
+// 创建响应代码到http状态码的映射函数. 优先级: HttpStatusMapping > RegisterCode注册 > HttpStatusDefault
+func createHttpStatusFunc(conf *Config) func(code int) int {
+	if conf.HttpStatusCompatible {
+		// 兼容旧逻辑, 总是返回200
+		return func(code int) int {
+			return http.StatusOK
+		}
+	}
+	return func(code int) int {
+		if status, ok := conf.HttpStatusMapping[code]; ok {
+			return status
+		}
+		if c, ok := LookupCode(code); ok && c.HttpStatus != 0 {
+			return c.HttpStatus
+		}
+		return conf.HttpStatusDefault
+	}
+}
+
+// 创建响应代码到grpc状态码的映射函数. 优先级: GrpcStatusMapping > RegisterCode注册 > codes.Unknown
+func createGrpcStatusFunc(conf *Config) func(code int) codes.Code {
+	return func(code int) codes.Code {
+		if status, ok := conf.GrpcStatusMapping[code]; ok {
+			return status
+		}
+		if c, ok := LookupCode(code); ok {
+			return c.GrpcCode
+		}
+		return codes.Unknown
+	}
+}
@@ -0,0 +1,48 @@
+package apix
+
+import (
+	"github.com/obase/api"
+	"net/http"
+	"testing"
+)
+
+func TestHttpStatusFunc(t *testing.T) {
+	if _, ok := LookupCode(40401); !ok {
+		RegisterCode(40401, "TEST_STATUS_NOT_FOUND", http.StatusNotFound, 0, "测试")
+	}
+	cases := []struct {
+		name string
+		conf *Config
+		code int
+		want int
+	}{
+		{"success", &Config{}, api.SUCCESS, http.StatusOK},
+		{"registry", &Config{}, 40401, http.StatusNotFound},
+		{"builtin", &Config{}, api.PARSING_REQUEST_ERROR, http.StatusBadRequest},
+		{"default", &Config{}, 40402, http.StatusInternalServerError},
+		{"custom default", &Config{HttpStatusDefault: http.StatusBadGateway}, 40402, http.StatusBadGateway},
+		{"mapping over registry", &Config{HttpStatusMapping: map[int]int{40401: http.StatusGone}}, 40401, http.StatusGone},
+		{"mapping over default", &Config{HttpStatusMapping: map[int]int{40402: http.StatusConflict}}, 40402, http.StatusConflict},
+		{"compatible over mapping", &Config{HttpStatusCompatible: true, HttpStatusMapping: map[int]int{40401: http.StatusGone}}, 40401, http.StatusOK},
+		{"compatible over registry", &Config{HttpStatusCompatible: true}, api.PARSING_REQUEST_ERROR, http.StatusOK},
+	}
+	for _, c := range cases {
+		if got := createHttpStatusFunc(mergeConfig(c.conf))(c.code); got != c.want {
+			t.Errorf("%s: status(%v) = %v, want %v", c.name, c.code, got, c.want)
+		}
+	}
+}
+
+func TestValidateHttpStatus(t *testing.T) {
+	if err := validateHttpStatus(mergeConfig(&Config{HttpStatusMapping: map[int]int{1001: http.StatusNotFound}})); err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range []int{0, 99, 1000, -1} {
+		if err := validateHttpStatus(mergeConfig(&Config{HttpStatusMapping: map[int]int{1001: status}})); err == nil {
+			t.Fatalf("status %v should be rejected", status)
+		}
+	}
+	if err := validateHttpStatus(mergeConfig(&Config{HttpStatusDefault: 1000})); err == nil {
+		t.Fatal("invalid default should be rejected")
+	}
+}
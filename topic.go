@@ -0,0 +1,190 @@
+package apix
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/obase/api"
+	"github.com/obase/log"
+	"sync"
+)
+
+/*
+主题控制操作, 客户端可发送{"id":...,"op":"join","topic":"xxx"}. 串行模式下只识别wbskTopicOps允许的操作, 其余消息仍作为方法参数.
+操作前依次执行方法的OnMessage与OnTopic钩子, 可按操作与主题鉴权; 多路复用入口须以method指定方法, 先通过该方法的过滤器与OnConnect
+*/
+const (
+	TOPIC_OP_JOIN      = "join"
+	TOPIC_OP_LEAVE     = "leave"
+	TOPIC_OP_BROADCAST = "broadcast"
+)
+
+/*主题注册表, 进程内维护主题与会话的订阅关系*/
+type topicRegistry struct {
+	sync.RWMutex
+	topics map[string]map[*Session]struct{}
+}
+
+var topics = &topicRegistry{
+	topics: make(map[string]map[*Session]struct{}),
+}
+
+func (r *topicRegistry) join(s *Session, topic string) {
+	r.Lock()
+	defer r.Unlock()
+	select {
+	case <-s.done:
+		return // 已经关闭
+	default:
+	}
+	members := r.topics[topic]
+	if members == nil {
+		members = make(map[*Session]struct{})
+		r.topics[topic] = members
+	}
+	members[s] = struct{}{}
+	s.topics[topic] = struct{}{}
+}
+
+func (r *topicRegistry) leave(s *Session, topic string) {
+	r.Lock()
+	r.remove(s, topic)
+	r.Unlock()
+}
+
+// 会话关闭时退订全部主题
+func (r *topicRegistry) leaveAll(s *Session) {
+	r.Lock()
+	for topic := range s.topics {
+		r.remove(s, topic)
+	}
+	r.Unlock()
+}
+
+// 调用者需持有写锁
+func (r *topicRegistry) remove(s *Session, topic string) {
+	delete(s.topics, topic)
+	if members := r.topics[topic]; members != nil {
+		delete(members, s)
+		if len(members) == 0 {
+			delete(r.topics, topic)
+		}
+	}
+}
+
+// 恢复会话时由新连接继承订阅
+func (r *topicRegistry) replace(prev *Session, s *Session) {
+	r.Lock()
+	defer r.Unlock()
+	for topic := range prev.topics {
+		if members := r.topics[topic]; members != nil {
+			delete(members, prev)
+			members[s] = struct{}{}
+		}
+		s.topics[topic] = struct{}{}
+	}
+	prev.topics = make(map[string]struct{})
+}
+
+func (r *topicRegistry) members(topic string) []*Session {
+	r.RLock()
+	defer r.RUnlock()
+	members := r.topics[topic]
+	ret := make([]*Session, 0, len(members))
+	for s := range members {
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+/*向主题的全部会话广播api.Response格式的消息, 返回本实例成功投递的会话数. 发送队列已满的会话会丢弃该消息. 配置总线后同时广播到其他实例*/
+func Broadcast(topic string, tag string, data interface{}) (int, error) {
+	wdata, err := json.Marshal(&socketReply{
+		Code:  api.SUCCESS,
+		Data:  data,
+		Tag:   tag,
+		Topic: topic,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return broadcastFrame(topic, wdata), publishBus(BUS_KIND_BROADCAST, topic, wdata)
+}
+
+func broadcastFrame(topic string, wdata []byte) int {
+	count := 0
+	for _, s := range topics.members(topic) {
+		if err := s.offer(websocket.TextMessage, wdata); err == nil {
+			count++
+		} else if err == ErrSendQueueFull {
+			log.Warn(nil, "broadcast %v dropped for session %v: %v", topic, s.id, err)
+		}
+	}
+	return count
+}
+
+// 串行模式的消息即方法参数, 只有op为允许操作的json对象才视为控制消息, 否则返回nil
+func parseTopicOp(rdata []byte, ops []string) *socketFrame {
+	if len(ops) == 0 || len(rdata) == 0 || rdata[0] != '{' {
+		return nil
+	}
+	var frame socketFrame
+	if err := json.Unmarshal(rdata, &frame); err != nil || !allowTopicOp(ops, frame.Op) {
+		return nil
+	}
+	return &frame
+}
+
+func allowTopicOp(ops []string, op string) bool {
+	for _, v := range ops {
+		if v == op {
+			return true
+		}
+	}
+	return false
+}
+
+// 处理客户端的主题控制消息, ops为允许的操作. 解析帧对应的方法并执行其钩子, 拒绝则回复错误
+func handleTopicOp(c *gin.Context, s *Session, ops []string, frame *socketFrame, tag string, resolve socketResolver) *socketReply {
+	if !allowTopicOp(ops, frame.Op) || frame.Topic == "" {
+		return &socketReply{
+			Id:   frame.Id,
+			Code: api.PARSING_REQUEST_ERROR,
+			Msg:  "unsupported topic op: " + frame.Op,
+			Tag:  tag,
+		}
+	}
+	fc, _, _, hooks, err := resolve(frame)
+	if err == nil {
+		err = hooks.topic(fc, s, frame)
+	}
+	if err != nil {
+		log.Warn(c, "%s session %v topic %v %v rejected: %v", tag, s.id, frame.Op, frame.Topic, err)
+		return newSocketReply(c, frame.Id, nil, err, tag)
+	}
+	switch frame.Op {
+	case TOPIC_OP_JOIN:
+		s.Join(frame.Topic)
+	case TOPIC_OP_LEAVE:
+		s.Leave(frame.Topic)
+	case TOPIC_OP_BROADCAST:
+		var data interface{}
+		if len(frame.Data) > 0 {
+			data = frame.Data
+		}
+		if _, err := Broadcast(frame.Topic, tag, data); err != nil {
+			return &socketReply{
+				Id:   frame.Id,
+				Code: api.EXECUTE_SERVICE_ERROR,
+				Msg:  err.Error(),
+				Tag:  tag,
+			}
+		}
+	}
+	return &socketReply{
+		Id:    frame.Id,
+		Code:  api.SUCCESS,
+		Tag:   tag,
+		Topic: frame.Topic,
+	}
+}
@@ -0,0 +1,370 @@
+package apix
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/obase/api"
+	"github.com/obase/log"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+分布式追踪, 使用W3C trace context(traceparent)传播:
+1. http从请求头, websocket从帧的traceparent字段或升级请求头, grpc从元数据提取上游的trace
+2. 每个POST调用, websocket消息及grpc调用创建一个server span, UnaryClientInterceptor为下游grpc调用创建client span并注入元数据
+3. 方法内可用TraceId(ctx)获取trace id, 响应中携带traceId
+4. 通过SpanExporter导出, 内置stdout与otlp(OTLP/HTTP JSON)
+*/
+const (
+	TRACE_HEADER   = "traceparent"       // http头及grpc元数据的key
+	TRACE_SPAN_KEY = "_apix_trace_span_" // context中保存*Span的key
+
+	TRACE_EXPORTER_STDOUT = "stdout"
+	TRACE_EXPORTER_OTLP   = "otlp"
+
+	SPAN_KIND_SERVER = "server"
+	SPAN_KIND_CLIENT = "client"
+)
+
+/*已完成的span, 交给SpanExporter导出*/
+type Span struct {
+	TraceId    string            `json:"traceId"`
+	SpanId     string            `json:"spanId"`
+	ParentId   string            `json:"parentId,omitempty"`
+	Name       string            `json:"name"`
+	Kind       string            `json:"kind"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Code       int               `json:"code"` // 响应代码
+	Attributes map[string]string `json:"attributes,omitempty"`
+	sampled    bool
+}
+
+/*span导出接口, Export在请求的goroutine中调用, 实现应避免阻塞*/
+type SpanExporter interface {
+	Export(span *Span)
+	Close()
+}
+
+var tracer *traceProvider // 为空表示未启用追踪
+
+type traceProvider struct {
+	exporter SpanExporter
+	rate     float64 // 新trace的采样率
+}
+
+// 根据配置创建导出器
+func createSpanExporter(conf *Config) (SpanExporter, error) {
+	switch strings.ToLower(conf.TraceExporter) {
+	case "":
+		return nil, nil
+	case TRACE_EXPORTER_STDOUT:
+		return NewStdoutExporter(), nil
+	case TRACE_EXPORTER_OTLP:
+		return NewOtlpExporter(conf.TraceEndpoint, conf.Name), nil
+	}
+	return nil, errors.New("unknown trace exporter: " + conf.TraceExporter)
+}
+
+func setupTracer(exporter SpanExporter, conf *Config) {
+	if exporter == nil {
+		tracer = nil
+		return
+	}
+	tracer = &traceProvider{
+		exporter: exporter,
+		rate:     *conf.TraceSampleRate,
+	}
+}
+
+// 创建span, parent为上游traceparent, 为空或非法则开始新trace. 未启用追踪返回nil
+func startSpan(parent string, name string, kind string) *Span {
+	t := tracer
+	if t == nil {
+		return nil
+	}
+	span := &Span{
+		SpanId: newTraceId(8),
+		Name:   name,
+		Kind:   kind,
+		Start:  time.Now(),
+	}
+	if traceId, parentId, sampled, ok := parseTraceparent(parent); ok {
+		span.TraceId, span.ParentId, span.sampled = traceId, parentId, sampled
+	} else {
+		span.TraceId = newTraceId(16)
+		span.sampled = t.rate >= 1 || mrand.Float64() < t.rate
+	}
+	return span
+}
+
+// 创建子span
+func (s *Span) child(name string, kind string) *Span {
+	if s == nil {
+		return nil
+	}
+	return &Span{
+		TraceId:  s.TraceId,
+		SpanId:   newTraceId(8),
+		ParentId: s.SpanId,
+		Name:     name,
+		Kind:     kind,
+		Start:    time.Now(),
+		sampled:  s.sampled,
+	}
+}
+
+/*设置属性, 可在方法内通过SpanFromContext(ctx)添加*/
+func (s *Span) SetAttribute(key string, value string) {
+	if s == nil {
+		return
+	}
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+}
+
+// 结束span并导出
+func (s *Span) finish(code int) {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	s.Code = code
+	if t := tracer; t != nil && s.sampled {
+		t.exporter.Export(s)
+	}
+}
+
+/*W3C traceparent格式: 00-<trace id>-<span id>-<flags>*/
+func (s *Span) Traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + s.TraceId + "-" + s.SpanId + "-" + flags
+}
+
+func parseTraceparent(v string) (traceId string, spanId string, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if !isHex(parts[1]) || !isHex(parts[2]) || strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return
+	}
+	return parts[1], parts[2], flags&1 == 1, true
+}
+
+func isHex(v string) bool {
+	for _, c := range v {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func newTraceId(size int) string {
+	bs := make([]byte, size)
+	rand.Read(bs)
+	return hex.EncodeToString(bs)
+}
+
+/*当前请求的span, 未启用追踪返回nil*/
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	if s, ok := ctx.Value(TRACE_SPAN_KEY).(*Span); ok {
+		return s
+	}
+	return nil
+}
+
+/*当前请求的trace id, 用于日志关联. 未启用追踪返回空*/
+func TraceId(ctx context.Context) string {
+	if s := SpanFromContext(ctx); s != nil {
+		return s.TraceId
+	}
+	return ""
+}
+
+/*向下游http请求注入traceparent*/
+func InjectTraceHeader(ctx context.Context, header http.Header) {
+	if s := SpanFromContext(ctx); s != nil {
+		header.Set(TRACE_HEADER, s.Traceparent())
+	}
+}
+
+/*输出到标准输出, 每行一个json*/
+type stdoutExporter struct {
+	sync.Mutex
+}
+
+func NewStdoutExporter() SpanExporter {
+	return &stdoutExporter{}
+}
+
+func (e *stdoutExporter) Export(span *Span) {
+	bs, _ := json.Marshal(span)
+	e.Lock()
+	os.Stdout.Write(append(bs, '\n'))
+	e.Unlock()
+}
+
+func (e *stdoutExporter) Close() {
+}
+
+/*以OTLP/HTTP JSON批量发送到本地collector, 如http://127.0.0.1:4318/v1/traces*/
+type otlpExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+	queue    chan *Span
+	done     chan struct{}
+	once     sync.Once
+}
+
+const (
+	otlpBatchSize     = 512
+	otlpQueueSize     = 4096
+	otlpFlushInterval = time.Second
+)
+
+func NewOtlpExporter(endpoint string, service string) SpanExporter {
+	e := &otlpExporter{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		queue:    make(chan *Span, otlpQueueSize),
+		done:     make(chan struct{}),
+	}
+	go e.loop()
+	return e
+}
+
+// 队列已满则丢弃, 不阻塞请求
+func (e *otlpExporter) Export(span *Span) {
+	select {
+	case e.queue <- span:
+	default:
+	}
+}
+
+func (e *otlpExporter) Close() {
+	e.once.Do(func() {
+		close(e.queue)
+		<-e.done
+	})
+}
+
+func (e *otlpExporter) loop() {
+	defer close(e.done)
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, otlpBatchSize)
+	for {
+		select {
+		case span, ok := <-e.queue:
+			if !ok {
+				e.flush(batch)
+				return
+			}
+			if batch = append(batch, span); len(batch) >= otlpBatchSize {
+				e.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			e.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (e *otlpExporter) flush(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	bs, _ := json.Marshal(otlpRequest(e.service, batch))
+	rsp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(bs))
+	if err != nil {
+		log.Error(nil, "otlp export error: %v", err)
+		return
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		log.Error(nil, "otlp export status: %v", rsp.Status)
+	}
+}
+
+type otlpKeyValue struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+func otlpAttributes(attrs map[string]string) []otlpKeyValue {
+	ret := make([]otlpKeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		ret = append(ret, otlpKeyValue{Key: k, Value: map[string]string{"stringValue": v}})
+	}
+	return ret
+}
+
+// OTLP/HTTP JSON格式的ExportTraceServiceRequest
+func otlpRequest(service string, batch []*Span) interface{} {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		kind := 2 // SPAN_KIND_SERVER
+		if s.Kind == SPAN_KIND_CLIENT {
+			kind = 3
+		}
+		status := map[string]interface{}{"code": 1} // STATUS_CODE_OK
+		if s.Code != api.SUCCESS {
+			status = map[string]interface{}{"code": 2, "message": strconv.Itoa(s.Code)} // STATUS_CODE_ERROR
+		}
+		attrs := otlpAttributes(s.Attributes)
+		attrs = append(attrs, otlpKeyValue{Key: "apix.code", Value: map[string]string{"intValue": strconv.Itoa(s.Code)}})
+		spans = append(spans, map[string]interface{}{
+			"traceId":           s.TraceId,
+			"spanId":            s.SpanId,
+			"parentSpanId":      s.ParentId,
+			"name":              s.Name,
+			"kind":              kind,
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        attrs,
+			"status":            status,
+		})
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]string{"service.name": service}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "apix"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,95 @@
+package apix
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 记录导出的span
+type recordExporter struct {
+	sync.Mutex
+	spans []*Span
+}
+
+func (e *recordExporter) Export(span *Span) {
+	e.Lock()
+	e.spans = append(e.spans, span)
+	e.Unlock()
+}
+
+func (e *recordExporter) Close() {
+}
+
+func TestParseTraceparent(t *testing.T) {
+	traceId, spanId, sampled, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || traceId != "4bf92f3577b34da6a3ce929d0e0e4736" || spanId != "00f067aa0ba902b7" || !sampled {
+		t.Fatalf("unexpected result: %v %v %v %v", traceId, spanId, sampled, ok)
+	}
+	for _, v := range []string{
+		"",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+	} {
+		if _, _, _, ok := parseTraceparent(v); ok {
+			t.Errorf("parseTraceparent(%q) should fail", v)
+		}
+	}
+}
+
+func TestTraceHttp(t *testing.T) {
+	exporter := &recordExporter{}
+	setupTracer(exporter, &Config{TraceSampleRate: SampleRate(1)})
+	defer setupTracer(nil, nil)
+
+	var inner string
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.POST("/test", createHandleFunc(func(ctx context.Context, rdata []byte) (interface{}, error) {
+		inner = TraceId(ctx)
+		return "ok", nil
+	}, "Test.Trace", func(code int) int { return http.StatusOK }))
+
+	req := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader("{}"))
+	req.Header.Set(TRACE_HEADER, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+
+	var reply struct {
+		Code    int    `json:"code"`
+		TraceId string `json:"traceId"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &reply)
+	if reply.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || inner != reply.TraceId {
+		t.Fatalf("unexpected trace id: reply=%v inner=%v", reply.TraceId, inner)
+	}
+	if len(exporter.spans) != 1 {
+		t.Fatalf("unexpected spans: %v", len(exporter.spans))
+	}
+	span := exporter.spans[0]
+	if span.ParentId != "00f067aa0ba902b7" || span.Name != "Test.Trace" || span.Kind != SPAN_KIND_SERVER || span.Code != reply.Code {
+		t.Fatalf("unexpected span: %+v", span)
+	}
+}
+
+func TestTraceSampleRateZero(t *testing.T) {
+	conf := &Config{TraceSampleRate: SampleRate(0)}
+	if rate := *mergeConfig(conf).TraceSampleRate; rate != 0 {
+		t.Fatalf("explicit 0 rewritten to %v", rate)
+	}
+	if rate := *mergeConfig(&Config{}).TraceSampleRate; rate != 1 {
+		t.Fatalf("default rate %v", rate)
+	}
+	setupTracer(&recordExporter{}, mergeConfig(conf))
+	defer setupTracer(nil, nil)
+	if span := startSpan("", "Test.Rate", SPAN_KIND_SERVER); span != nil && span.sampled {
+		t.Fatal("new trace sampled with rate 0")
+	}
+}